@@ -0,0 +1,316 @@
+package toolkit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	defaultMaxArchiveSize      = 1 << 30
+	defaultMaxArchiveEntries   = 1000
+	defaultMaxCompressionRatio = 100
+	tarMagicOffset             = 257
+	tarMagicEnd                = 262
+)
+
+var errNotArchive = errors.New("not an archive")
+
+type ArchiveOptions struct {
+	MaxSize             int64
+	MaxEntries          int
+	MaxCompressionRatio int64
+}
+
+func (t *Tools) extractsArchive(fileType string, part *uploadPart) bool {
+	if t.ExtractArchives == nil || part.fromArchive || part.sink != nil {
+		return false
+	}
+
+	switch fileType {
+	case "application/zip", "application/x-tar", "application/x-gzip":
+		return true
+	}
+	return false
+}
+
+// archiveExtraction saves the entries of one uploaded archive as uploads of
+// their own while keeping track of the limits that apply to the archive as a
+// whole.
+type archiveExtraction struct {
+	t          *Tools
+	ctx        context.Context
+	part       *uploadPart
+	uploadDir  string
+	renameFile bool
+
+	maxEntries int
+	entries    int
+
+	// The uncompressed size is capped by MaxSize and by the compression
+	// ratio, whichever is lower; limitErr records which one applies.
+	limit    int64
+	limitErr error
+	total    int64
+
+	files []*UploadedFile
+	names map[string]bool
+}
+
+// extractArchive saves every regular file in the staged archive at key to
+// uploadDir. Directory structure is not kept: each entry is named like any
+// other upload, with its path inside the archive as the original file name,
+// and entries whose names clash get a numbered suffix.
+// It returns errNotArchive for gzip files that do not contain a tar archive.
+func (t *Tools) extractArchive(ctx context.Context, key, fileType, uploadDir string,
+	renameFile bool, archive *UploadedFile, part *uploadPart) ([]*UploadedFile, error) {
+	opts := *t.ExtractArchives
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxArchiveSize
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultMaxArchiveEntries
+	}
+	if opts.MaxCompressionRatio <= 0 {
+		opts.MaxCompressionRatio = defaultMaxCompressionRatio
+	}
+
+	x := &archiveExtraction{
+		t:          t,
+		ctx:        ctx,
+		part:       part,
+		uploadDir:  uploadDir,
+		renameFile: renameFile,
+		maxEntries: opts.MaxEntries,
+		limit:      opts.MaxSize,
+		limitErr:   ErrArchiveTooLarge,
+		names:      make(map[string]bool),
+	}
+	if ratioLimit := archive.FileSize * opts.MaxCompressionRatio; ratioLimit < x.limit {
+		x.limit = ratioLimit
+		x.limitErr = ErrCompressionRatio
+	}
+
+	var err error
+	if fileType == "application/zip" {
+		err = x.extractZip(key, archive.FileSize)
+	} else {
+		err = x.extractTar(key, fileType == "application/x-gzip")
+	}
+	if err != nil {
+		t.removeUploadedFiles(context.WithoutCancel(ctx), uploadDir, x.files)
+		return nil, err
+	}
+
+	return x.files, nil
+}
+
+func (x *archiveExtraction) extractZip(key string, size int64) error {
+	content, err := x.t.storage().Get(x.ctx, key)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	ra, ok := content.(io.ReaderAt)
+	if !ok {
+		// zip needs random access, so archives from backends that only
+		// stream are copied to a local temporary file first.
+		tmp, err := os.CreateTemp("", tempFilePrefix+"*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if _, err := io.Copy(tmp, content); err != nil {
+			return err
+		}
+		ra = tmp
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return x.part.error(ErrInvalidArchive)
+	}
+
+	for _, f := range zr.File {
+		mode := f.Mode()
+
+		switch {
+		case mode&fs.ModeSymlink != 0, !mode.IsRegular() && !mode.IsDir():
+			return x.unsafeEntry(f.Name)
+		case mode.IsDir():
+			if err := x.addDir(f.Name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return x.part.error(ErrInvalidArchive)
+		}
+		err = x.addFile(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *archiveExtraction) extractTar(key string, gzipped bool) error {
+	content, err := x.t.storage().Get(x.ctx, key)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	var r io.Reader = content
+	if gzipped {
+		gz, err := gzip.NewReader(content)
+		if err != nil {
+			return x.part.error(ErrInvalidArchive)
+		}
+		defer gz.Close()
+
+		br := bufio.NewReader(gz)
+		head, _ := br.Peek(tarMagicEnd)
+		if len(head) < tarMagicEnd || string(head[tarMagicOffset:tarMagicEnd]) != "ustar" {
+			return errNotArchive
+		}
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return x.part.error(ErrInvalidArchive)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			err = x.addFile(hdr.Name, tr)
+		case tar.TypeDir:
+			err = x.addDir(hdr.Name)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			// Links, devices and fifos have no place in an upload.
+			err = x.unsafeEntry(hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *archiveExtraction) count() error {
+	x.entries++
+	if x.entries > x.maxEntries {
+		uploadErr := x.part.error(ErrTooManyArchiveEntries)
+		uploadErr.Limit = int64(x.maxEntries)
+		return uploadErr
+	}
+	return nil
+}
+
+func (x *archiveExtraction) unsafeEntry(name string) error {
+	return &UploadError{Err: ErrUnsafeArchiveEntry, Field: x.part.field, FileName: name}
+}
+
+func (x *archiveExtraction) addDir(name string) error {
+	if _, ok := archiveEntryName(name); !ok {
+		return x.unsafeEntry(name)
+	}
+	return x.count()
+}
+
+func (x *archiveExtraction) addFile(name string, r io.Reader) error {
+	entryName, ok := archiveEntryName(name)
+	if !ok {
+		return x.unsafeEntry(name)
+	}
+	if err := x.count(); err != nil {
+		return err
+	}
+
+	// Every entry is a file of the field, so it counts against the field's
+	// MaxFiles just as a file uploaded on its own would.
+	if policy, ok := x.t.UploadPolicies[x.part.field]; ok && policy.MaxFiles > 0 &&
+		x.part.fieldFiles+len(x.files) >= policy.MaxFiles {
+		uploadErr := x.part.error(ErrTooManyFiles)
+		uploadErr.Limit = int64(policy.MaxFiles)
+		return uploadErr
+	}
+
+	uploadedFile, err := x.t.saveUploadedFile(x.ctx, &uploadPart{
+		field:       x.part.field,
+		fileName:    entryName,
+		r:           &archiveEntryReader{r: r, x: x},
+		fromArchive: true,
+		rollback:    x.part.rollback,
+		reserved:    x.names,
+		quota:       x.part.quota,
+	}, x.uploadDir, x.renameFile)
+	if err != nil {
+		if errors.Is(err, x.limitErr) {
+			uploadErr := x.part.error(x.limitErr)
+			uploadErr.Limit = x.limit
+			return uploadErr
+		}
+		return err
+	}
+
+	x.files = append(x.files, uploadedFile)
+	x.names[strings.ToLower(uploadedFile.NewFileName)] = true
+	for _, v := range uploadedFile.Variants {
+		x.names[strings.ToLower(v.FileName)] = true
+	}
+	return nil
+}
+
+type archiveEntryReader struct {
+	r io.Reader
+	x *archiveExtraction
+}
+
+func (ar *archiveEntryReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	ar.x.total += int64(n)
+	if ar.x.total > ar.x.limit {
+		return n, ar.x.limitErr
+	}
+	return n, err
+}
+
+// archiveEntryName cleans the path of an archive entry and reports whether it
+// stays inside the extraction directory.
+func archiveEntryName(name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", false
+		}
+	}
+
+	return path.Clean(name), true
+}
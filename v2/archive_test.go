@@ -0,0 +1,266 @@
+package toolkit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+type testArchiveEntry struct {
+	name    string
+	content []byte
+	symlink bool
+}
+
+func newTestZip(t *testing.T, entries ...testArchiveEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		// OpenDocument and EPUB files keep their mimetype entry uncompressed.
+		if e.name == "mimetype" {
+			header.Method = zip.Store
+		}
+		if e.symlink {
+			header.SetMode(fs.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestTar(t *testing.T, entries ...testArchiveEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content))}
+		if e.symlink {
+			header = &tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(e.content)
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestTarGz(t *testing.T, entries ...testArchiveEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(newTestTar(t, entries...))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTools_UploadExtractArchives(t *testing.T) {
+	img := readTestImage(t)
+	entries := []testArchiveEntry{
+		{name: "assets/", content: nil},
+		{name: "assets/logo.jpg", content: img},
+		{name: "readme.txt", content: []byte("hello world")},
+	}
+
+	archives := map[string][]byte{
+		"bundle.zip":    newTestZip(t, entries...),
+		"bundle.tar.gz": newTestTarGz(t, entries[1:]...),
+	}
+
+	for name, archive := range archives {
+		uploadDir := t.TempDir()
+		testTools := Tools{
+			AllowedFileTypes: []string{"image/*", "text/plain"},
+			ExtractArchives:  &ArchiveOptions{},
+		}
+
+		uploadedFiles, err := testTools.UploadMultipleFiles(
+			newUploadRequest(t, testFormFile{"file", name, archive}), uploadDir, false)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		var originalNames []string
+		for _, f := range uploadedFiles {
+			originalNames = append(originalNames, f.OriginalFileName)
+		}
+		sort.Strings(originalNames)
+		if len(originalNames) != 2 || originalNames[0] != "assets/logo.jpg" || originalNames[1] != "readme.txt" {
+			t.Errorf("%s: unexpected extracted files %v", name, originalNames)
+		}
+
+		stored, err := os.ReadFile(filepath.Join(uploadDir, "logo.jpg"))
+		if err != nil || !bytes.Equal(stored, img) {
+			t.Errorf("%s: extracted image does not match: %v", name, err)
+		}
+
+		dirEntries, _ := os.ReadDir(uploadDir)
+		if len(dirEntries) != 2 {
+			t.Errorf("%s: expected only the extracted files on disk, found %d", name, len(dirEntries))
+		}
+	}
+}
+
+func TestTools_UploadExtractArchiveNameClash(t *testing.T) {
+	archive := newTestZip(t,
+		testArchiveEntry{name: "a/readme.txt", content: []byte("a")},
+		testArchiveEntry{name: "b/readme.txt", content: []byte("b")},
+		testArchiveEntry{name: "c/README.txt", content: []byte("c")})
+
+	for _, policy := range []CollisionPolicy{CollisionOverwrite, CollisionError, CollisionSuffix} {
+		uploadDir := t.TempDir()
+		testTools := Tools{ExtractArchives: &ArchiveOptions{}, OnCollision: policy}
+
+		uploadedFiles, err := testTools.UploadMultipleFiles(
+			newUploadRequest(t, testFormFile{"file", "bundle.zip", archive}), uploadDir, false)
+		if err != nil {
+			t.Fatalf("policy %d: %v", policy, err)
+		}
+
+		expected := map[string]string{"readme.txt": "a", "readme (1).txt": "b", "README (2).txt": "c"}
+		if len(uploadedFiles) != len(expected) {
+			t.Errorf("policy %d: expected %d files, got %d", policy, len(expected), len(uploadedFiles))
+		}
+		for _, f := range uploadedFiles {
+			content, err := os.ReadFile(filepath.Join(uploadDir, f.NewFileName))
+			if err != nil || string(content) != expected[f.NewFileName] {
+				t.Errorf("policy %d: expected %s to hold %q, got %q (%v)", policy, f.NewFileName,
+					expected[f.NewFileName], content, err)
+			}
+		}
+	}
+}
+
+func TestTools_UploadExtractArchiveLimits(t *testing.T) {
+	text := []byte("hello world")
+
+	var archiveTests = []struct {
+		name         string
+		archive      []byte
+		opts         ArchiveOptions
+		allowedTypes []string
+		policies     map[string]UploadPolicy
+		expectedErr  error
+	}{
+		{name: "zip slip",
+			archive:     newTestZip(t, testArchiveEntry{name: "ok.txt", content: text}, testArchiveEntry{name: "../evil.txt", content: text}),
+			expectedErr: ErrUnsafeArchiveEntry},
+		{name: "windows zip slip",
+			archive:     newTestZip(t, testArchiveEntry{name: `a\..\..\evil.txt`, content: text}),
+			expectedErr: ErrUnsafeArchiveEntry},
+		{name: "absolute path",
+			archive:     newTestTarGz(t, testArchiveEntry{name: "/etc/cron.d/evil", content: text}),
+			expectedErr: ErrUnsafeArchiveEntry},
+		{name: "zip symlink",
+			archive:     newTestZip(t, testArchiveEntry{name: "link", content: []byte("/etc/passwd"), symlink: true}),
+			expectedErr: ErrUnsafeArchiveEntry},
+		{name: "tar symlink",
+			archive:     newTestTarGz(t, testArchiveEntry{name: "ok.txt", content: text}, testArchiveEntry{name: "link", symlink: true}),
+			expectedErr: ErrUnsafeArchiveEntry},
+		{name: "total size",
+			archive:     newTestZip(t, testArchiveEntry{name: "a.txt", content: text}, testArchiveEntry{name: "b.txt", content: text}),
+			opts:        ArchiveOptions{MaxSize: 15},
+			expectedErr: ErrArchiveTooLarge},
+		{name: "compression ratio",
+			archive:     newTestZip(t, testArchiveEntry{name: "zeros.txt", content: bytes.Repeat([]byte("a"), 1<<20)}),
+			expectedErr: ErrCompressionRatio},
+		{name: "entry count",
+			archive: newTestZip(t, testArchiveEntry{name: "a.txt", content: text},
+				testArchiveEntry{name: "b.txt", content: text}, testArchiveEntry{name: "c.txt", content: text}),
+			opts:        ArchiveOptions{MaxEntries: 2},
+			expectedErr: ErrTooManyArchiveEntries},
+		{name: "field file count",
+			archive: newTestZip(t, testArchiveEntry{name: "a.txt", content: text},
+				testArchiveEntry{name: "b.txt", content: text}, testArchiveEntry{name: "c.txt", content: text}),
+			policies:    map[string]UploadPolicy{"file": {MaxFiles: 1}},
+			expectedErr: ErrTooManyFiles},
+		{name: "entry type",
+			archive:      newTestZip(t, testArchiveEntry{name: "a.txt", content: text}),
+			allowedTypes: []string{"image/*"},
+			expectedErr:  ErrFileTypeNotAllowed},
+		{name: "corrupt zip",
+			archive:     append([]byte("PK\x03\x04"), bytes.Repeat([]byte{0}, 64)...),
+			expectedErr: ErrInvalidArchive},
+	}
+
+	for _, e := range archiveTests {
+		uploadDir := t.TempDir()
+		opts := e.opts
+		testTools := Tools{AllowedFileTypes: e.allowedTypes, ExtractArchives: &opts,
+			UploadPolicies: e.policies}
+
+		_, err := testTools.UploadMultipleFiles(
+			newUploadRequest(t, testFormFile{"file", "bundle", e.archive}), uploadDir)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+
+		dirEntries, _ := os.ReadDir(uploadDir)
+		if len(dirEntries) != 0 {
+			t.Errorf("%s: expected nothing to be left in the upload directory, found %d files",
+				e.name, len(dirEntries))
+		}
+	}
+}
+
+func TestTools_UploadArchiveWithoutExtraction(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("just some compressed text"))
+	gz.Close()
+
+	var uploadTests = []struct {
+		name    string
+		content []byte
+		opts    *ArchiveOptions
+	}{
+		{name: "extraction disabled", content: newTestZip(t, testArchiveEntry{name: "a.txt"})},
+		{name: "gzip without tar", content: gzipped.Bytes(), opts: &ArchiveOptions{}},
+	}
+
+	for _, e := range uploadTests {
+		uploadDir := t.TempDir()
+		testTools := Tools{ExtractArchives: e.opts}
+
+		uploadedFiles, err := testTools.UploadMultipleFiles(
+			newUploadRequest(t, testFormFile{"file", "upload", e.content}), uploadDir)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if len(uploadedFiles) != 1 {
+			t.Fatalf("%s: expected the archive to be stored as one file, got %d", e.name, len(uploadedFiles))
+		}
+
+		stored, _ := os.ReadFile(filepath.Join(uploadDir, uploadedFiles[0].NewFileName))
+		if !bytes.Equal(stored, e.content) {
+			t.Errorf("%s: stored archive does not match the upload", e.name)
+		}
+	}
+}
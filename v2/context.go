@@ -0,0 +1,201 @@
+package toolkit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFileTimeout error = &deadlineError{"the file took too long to upload"}
+	ErrIdleTimeout error = &deadlineError{"the upload stalled"}
+)
+
+// deadlineError reports a deadline of the toolkit's own, such as a per-file
+// timeout, while still matching context.DeadlineExceeded so callers can tell
+// every timeout apart from a rejected upload in the same way.
+type deadlineError struct {
+	msg string
+}
+
+func (e *deadlineError) Error() string   { return e.msg }
+func (e *deadlineError) Timeout() bool   { return true }
+func (e *deadlineError) Temporary() bool { return true }
+
+func (e *deadlineError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// fileContext bounds the time spent on a single file by FileTimeout.
+func (t *Tools) fileContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.FileTimeout > 0 {
+		return context.WithTimeoutCause(ctx, t.FileTimeout, ErrFileTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// contextReader lets reads that are blocked on the network return as soon as
+// the context is done or no data has arrived for the idle timeout. A single
+// goroutine reads the whole body. A read that is given up on keeps it, and the
+// connection, busy until the client sends more data or goes away, or the
+// server's ReadTimeout passes; the server cannot even close the body before
+// then, so servers that rely on these timeouts should set a ReadTimeout.
+type contextReader struct {
+	r    io.Reader
+	ctx  context.Context
+	idle time.Duration
+
+	buf      []byte
+	started  bool
+	pending  bool
+	requests chan []byte
+	results  chan readResult
+	done     chan struct{}
+	stopOnce sync.Once
+	timer    *time.Timer
+	err      error
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func newContextReader(ctx context.Context, r io.Reader, idle time.Duration) *contextReader {
+	return &contextReader{
+		r:        r,
+		ctx:      ctx,
+		idle:     idle,
+		requests: make(chan []byte, 1),
+		results:  make(chan readResult, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// wrapsBody reports whether reads of a request body with ctx need a
+// contextReader at all.
+func (t *Tools) wrapsBody(ctx context.Context) bool {
+	return t.FileTimeout > 0 || t.FileIdleTimeout > 0 || ctx.Done() != nil
+}
+
+func (cr *contextReader) run() {
+	for {
+		select {
+		case buf := <-cr.requests:
+			n, err := cr.r.Read(buf)
+			cr.results <- readResult{n, err}
+			if err != nil {
+				return
+			}
+		case <-cr.done:
+			return
+		}
+	}
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if err := context.Cause(cr.ctx); err != nil {
+		return 0, cr.fail(err)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if !cr.started {
+		cr.started = true
+		go cr.run()
+	}
+	if !cr.pending {
+		if len(cr.buf) < len(p) {
+			cr.buf = make([]byte, len(p))
+		}
+		cr.pending = true
+		cr.requests <- cr.buf[:len(p)]
+	}
+
+	var idle <-chan time.Time
+	if cr.idle > 0 {
+		if cr.timer == nil {
+			cr.timer = time.NewTimer(cr.idle)
+		} else {
+			cr.timer.Reset(cr.idle)
+		}
+		idle = cr.timer.C
+	}
+
+	select {
+	case res := <-cr.results:
+		cr.pending = false
+		if cr.timer != nil && !cr.timer.Stop() {
+			select {
+			case <-cr.timer.C:
+			default:
+			}
+		}
+		n := copy(p, cr.buf[:res.n])
+		if res.err != nil {
+			cr.err = res.err
+		}
+		return n, res.err
+	case <-cr.ctx.Done():
+		return 0, cr.fail(context.Cause(cr.ctx))
+	case <-idle:
+		return 0, cr.fail(ErrIdleTimeout)
+	}
+}
+
+// fail makes err stick and lets the reading goroutine go once any read it
+// is still waiting on returns.
+func (cr *contextReader) fail(err error) error {
+	cr.err = err
+	cr.stop()
+	return err
+}
+
+// stop releases the reading goroutine when the body is no longer needed.
+func (cr *contextReader) stop() {
+	cr.stopOnce.Do(func() { close(cr.done) })
+}
+
+func (cr *contextReader) Close() error {
+	if c, ok := cr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// setContext points subsequent reads at ctx, which lets a single request body
+// observe the deadline of whichever file is currently being read from it.
+func (cr *contextReader) setContext(ctx context.Context) {
+	cr.ctx = ctx
+}
+
+// contextError reports the reason ctx ended in place of err, which is
+// usually just a symptom of it.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+// doneReader stops reading once ctx is done. It covers data that is already
+// buffered, such as a parsed multipart file, where there is nothing to wait on.
+type doneReader struct {
+	r   io.Reader
+	ctx context.Context
+}
+
+func (dr *doneReader) Read(p []byte) (int, error) {
+	if err := context.Cause(dr.ctx); err != nil {
+		return 0, err
+	}
+	return dr.r.Read(p)
+}
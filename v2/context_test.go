@@ -0,0 +1,114 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTools_UploadContext(t *testing.T) {
+	var contextTests = []struct {
+		name        string
+		tools       Tools
+		cancel      bool
+		expectedErr error
+	}{
+		{name: "canceled", tools: Tools{StreamUploads: true}, cancel: true,
+			expectedErr: context.Canceled},
+		{name: "canceled while parsing", cancel: true, expectedErr: context.Canceled},
+		{name: "idle timeout", tools: Tools{StreamUploads: true, FileIdleTimeout: 50 * time.Millisecond},
+			expectedErr: ErrIdleTimeout},
+		{name: "file timeout", tools: Tools{StreamUploads: true, FileTimeout: 50 * time.Millisecond},
+			expectedErr: ErrFileTimeout},
+		{name: "staged file timeout", tools: Tools{StreamUploads: true, ContentAddressed: true,
+			FileTimeout: 50 * time.Millisecond}, expectedErr: ErrFileTimeout},
+	}
+
+	for _, e := range contextTests {
+		uploadDir := t.TempDir()
+
+		// The body sends part of a file and then stalls.
+		pr, pw := io.Pipe()
+		writer := multipart.NewWriter(pw)
+		go func() {
+			part, _ := writer.CreateFormFile("file", "a.txt")
+			part.Write(make([]byte, 16<<10))
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		request := httptest.NewRequest("POST", "/", pr).WithContext(ctx)
+		request.Header.Add("Content-Type", writer.FormDataContentType())
+		if e.cancel {
+			time.AfterFunc(50*time.Millisecond, cancel)
+		}
+
+		_, err := e.tools.UploadMultipleFiles(request, uploadDir)
+		cancel()
+		pw.Close()
+
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+
+		var uploadErr *UploadError
+		if errors.As(err, &uploadErr) {
+			t.Errorf("%s: expected a context error, got upload error %v", e.name, err)
+		}
+
+		if e.expectedErr != context.Canceled && !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected %v to match context.DeadlineExceeded", e.name, err)
+		}
+
+		entries, _ := os.ReadDir(uploadDir)
+		if len(entries) != 0 {
+			t.Errorf("%s: expected no partial files, found %d", e.name, len(entries))
+		}
+	}
+}
+
+func TestContextReader(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var cr *contextReader
+	buf := make([]byte, 32<<10)
+	allocs := testing.AllocsPerRun(1, func() {
+		cr = newContextReader(ctx, bytes.NewReader(data), time.Second)
+		defer cr.stop()
+
+		var read int
+		for {
+			n, err := cr.Read(buf)
+			read += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if read != len(data) {
+			t.Errorf("expected %d bytes, got %d", len(data), read)
+		}
+	})
+	// One buffer, one timer and one goroutine for the whole body, not one
+	// of each per Read.
+	if allocs > 20 {
+		t.Errorf("expected a handful of allocations for %d reads, got %.0f", len(data)/len(buf), allocs)
+	}
+
+	var testTools Tools
+	if testTools.wrapsBody(context.Background()) {
+		t.Error("expected no wrapping without timeouts or a cancelable context")
+	}
+	if !testTools.wrapsBody(ctx) {
+		t.Error("expected a cancelable context to be honored")
+	}
+}
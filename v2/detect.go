@@ -0,0 +1,278 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// fileTypeExtensions lists the extensions a detected type may be stored
+// under, preferred extension first. Generic types such as text/plain and
+// application/octet-stream are deliberately absent so any extension is
+// accepted for them.
+var fileTypeExtensions = map[string][]string{
+	"image/jpeg":                   {".jpg", ".jpeg", ".jpe", ".jfif"},
+	"image/png":                    {".png"},
+	"image/gif":                    {".gif"},
+	"image/webp":                   {".webp"},
+	"image/bmp":                    {".bmp"},
+	"image/tiff":                   {".tif", ".tiff"},
+	"image/heic":                   {".heic"},
+	"image/heif":                   {".heif", ".heic"},
+	"image/avif":                   {".avif"},
+	"image/svg+xml":                {".svg"},
+	"image/x-icon":                 {".ico"},
+	"application/pdf":              {".pdf"},
+	"application/zip":              {".zip"},
+	"application/x-gzip":           {".gz", ".tgz"},
+	"application/x-tar":            {".tar"},
+	"application/x-7z-compressed":  {".7z"},
+	"application/x-rar-compressed": {".rar"},
+	"application/x-ole-storage":    {".doc", ".xls", ".ppt", ".msg"},
+	"application/epub+zip":         {".epub"},
+	"application/wasm":             {".wasm"},
+	"application/ogg":              {".ogg", ".oga", ".ogv", ".opus"},
+	"video/mp4":                    {".mp4", ".m4v"},
+	"video/quicktime":              {".mov"},
+	"video/3gpp":                   {".3gp", ".3g2"},
+	"video/webm":                   {".webm"},
+	"video/avi":                    {".avi"},
+	"audio/mp4":                    {".m4a", ".m4b"},
+	"audio/mpeg":                   {".mp3"},
+	"audio/wave":                   {".wav"},
+	"audio/flac":                   {".flac"},
+	"font/woff":                    {".woff"},
+	"font/woff2":                   {".woff2"},
+	"font/ttf":                     {".ttf"},
+	"font/otf":                     {".otf"},
+	"text/html":                    {".html", ".htm"},
+	"text/xml":                     {".xml"},
+
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {".docx"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {".xlsx"},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {".pptx"},
+	"application/vnd.oasis.opendocument.text":                                   {".odt"},
+	"application/vnd.oasis.opendocument.spreadsheet":                            {".ods"},
+	"application/vnd.oasis.opendocument.presentation":                           {".odp"},
+}
+
+// zipContainerTypes are formats stored inside a zip archive. They are only
+// told apart from a plain zip by the entries near the start of the archive,
+// so a file detected as application/zip may still carry their extensions.
+var zipContainerTypes = []string{
+	"application/epub+zip",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"application/vnd.oasis.opendocument.text",
+	"application/vnd.oasis.opendocument.spreadsheet",
+	"application/vnd.oasis.opendocument.presentation",
+}
+
+var ooxmlPrefixes = map[string]string{
+	"word/": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"xl/":   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"ppt/":  "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+// DetectContentType extends http.DetectContentType with office documents and
+// other zip containers, ISO media files (mp4, mov, heic, avif), SVG, tar,
+// tiff, flac, 7z and legacy OLE documents. It considers at most the first
+// 8KB of data.
+func (t *Tools) DetectContentType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return zipContentType(data)
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return isoMediaContentType(string(data[8:12]))
+	case len(data) >= 262 && string(data[257:262]) == "ustar":
+		return "application/x-tar"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "image/tiff"
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(data, []byte("7z\xBC\xAF\x27\x1C")):
+		return "application/x-7z-compressed"
+	case bytes.HasPrefix(data, []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")):
+		return "application/x-ole-storage"
+	}
+
+	fileType := http.DetectContentType(data)
+	if strings.HasPrefix(fileType, "text/") && isSVG(data) {
+		return "image/svg+xml"
+	}
+	return fileType
+}
+
+// zipContentType looks at the names of the local file headers in data to
+// recognise OOXML, OpenDocument and EPUB files.
+func zipContentType(data []byte) string {
+	for i := 0; ; {
+		j := bytes.Index(data[i:], []byte("PK\x03\x04"))
+		if j < 0 {
+			break
+		}
+		header := data[i+j:]
+		i += j + 4
+
+		if len(header) < 30 {
+			break
+		}
+		nameLen := int(binary.LittleEndian.Uint16(header[26:]))
+		extraLen := int(binary.LittleEndian.Uint16(header[28:]))
+		if len(header) < 30+nameLen {
+			break
+		}
+		name := string(header[30 : 30+nameLen])
+
+		// OpenDocument and EPUB store their type uncompressed in the first
+		// entry. The size is not read from the header because writers that
+		// stream the archive leave it zero.
+		if name == "mimetype" && len(header) > 30+nameLen+extraLen {
+			content := header[30+nameLen+extraLen:]
+			for _, fileType := range zipContainerTypes {
+				if bytes.HasPrefix(content, []byte(fileType)) {
+					return fileType
+				}
+			}
+		}
+
+		for prefix, fileType := range ooxmlPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				return fileType
+			}
+		}
+	}
+
+	return "application/zip"
+}
+
+func isoMediaContentType(brand string) string {
+	switch {
+	case brand == "heic", brand == "heix", brand == "heim", brand == "heis",
+		brand == "hevc", brand == "hevx":
+		return "image/heic"
+	case brand == "mif1", brand == "msf1":
+		return "image/heif"
+	case brand == "avif", brand == "avis":
+		return "image/avif"
+	case brand == "qt  ":
+		return "video/quicktime"
+	case brand == "M4A ", brand == "M4B ":
+		return "audio/mp4"
+	case strings.HasPrefix(brand, "3g"):
+		return "video/3gpp"
+	default:
+		return "video/mp4"
+	}
+}
+
+// isSVG reports whether the text in data has an svg root element, skipping a
+// byte order mark, the XML declaration, comments and a doctype.
+func isSVG(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+
+	for {
+		data = bytes.TrimLeft(data, " \t\r\n")
+
+		var end []byte
+		switch {
+		case bytes.HasPrefix(data, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(data, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(data, []byte("<!")):
+			end = []byte(">")
+		default:
+			return len(data) > 4 && bytes.EqualFold(data[:4], []byte("<svg")) &&
+				strings.ContainsRune(" \t\r\n>", rune(data[4]))
+		}
+
+		i := bytes.Index(data, end)
+		if i < 0 {
+			return false
+		}
+		data = data[i+len(end):]
+	}
+}
+
+func baseMediaType(fileType string) string {
+	mediaType, _, err := mime.ParseMediaType(fileType)
+	if err != nil {
+		return strings.ToLower(fileType)
+	}
+	return mediaType
+}
+
+// extensionMatches reports whether ext is acceptable for content detected as
+// fileType. Extensions that no known type claims always match.
+func extensionMatches(fileType, ext string) bool {
+	ext = strings.ToLower(ext)
+	fileType = baseMediaType(fileType)
+
+	if !extensionClaimed(ext) {
+		return true
+	}
+	for _, x := range fileTypeExtensions[fileType] {
+		if x == ext {
+			return true
+		}
+	}
+
+	if fileType == "application/zip" {
+		for _, t := range zipContainerTypes {
+			for _, x := range fileTypeExtensions[t] {
+				if x == ext {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// storedExtension picks the extension a renamed file is stored under: the
+// client's extension when it fits the detected type, the preferred extension
+// of the detected type otherwise. Types that have none keep the client's
+// extension unless another type claims it, since the file would then be
+// served as that type; .txt or .bin is used instead.
+func storedExtension(fileType, ext string) string {
+	mediaType := baseMediaType(fileType)
+	exts, ok := fileTypeExtensions[mediaType]
+	if !ok {
+		if !extensionClaimed(ext) {
+			return ext
+		}
+		if strings.HasPrefix(mediaType, "text/") {
+			return ".txt"
+		}
+		return ".bin"
+	}
+
+	for _, x := range exts {
+		if strings.EqualFold(x, ext) {
+			return strings.ToLower(ext)
+		}
+	}
+	return exts[0]
+}
+
+// extensionClaimed reports whether ext belongs to a type in
+// fileTypeExtensions.
+func extensionClaimed(ext string) bool {
+	ext = strings.ToLower(ext)
+	for _, exts := range fileTypeExtensions {
+		for _, x := range exts {
+			if x == ext {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestTools_DetectContentType(t *testing.T) {
+	var detectTests = []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{name: "jpeg", data: readTestImage(t), expected: "image/jpeg"},
+		{name: "zip", data: newTestZip(t, testArchiveEntry{name: "a.txt"}, testArchiveEntry{name: "b.txt"}),
+			expected: "application/zip"},
+		{name: "docx", data: newTestZip(t, testArchiveEntry{name: "[Content_Types].xml"},
+			testArchiveEntry{name: "_rels/.rels"}, testArchiveEntry{name: "word/document.xml"}),
+			expected: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{name: "xlsx", data: newTestZip(t, testArchiveEntry{name: "[Content_Types].xml"},
+			testArchiveEntry{name: "xl/workbook.xml"}),
+			expected: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{name: "odt", data: newTestZip(t,
+			testArchiveEntry{name: "mimetype", content: []byte("application/vnd.oasis.opendocument.text")},
+			testArchiveEntry{name: "content.xml"}),
+			expected: "application/vnd.oasis.opendocument.text"},
+		{name: "tar", data: newTestTar(t, testArchiveEntry{name: "a.txt", content: []byte("hello")}),
+			expected: "application/x-tar"},
+		{name: "webp", data: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), expected: "image/webp"},
+		{name: "heic", data: []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), expected: "image/heic"},
+		{name: "avif", data: []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1"), expected: "image/avif"},
+		{name: "mp4", data: []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00isomiso2avc1mp41"), expected: "video/mp4"},
+		{name: "mov", data: []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00qt  "), expected: "video/quicktime"},
+		{name: "tiff", data: []byte("II*\x00\x08\x00\x00\x00"), expected: "image/tiff"},
+		{name: "svg", data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), expected: "image/svg+xml"},
+		{name: "svg with prolog",
+			data: []byte("\xEF\xBB\xBF<?xml version=\"1.0\"?>\n<!-- icon -->\n" +
+				"<!DOCTYPE svg PUBLIC \"-//W3C//DTD SVG 1.1//EN\" \"x\">\n<svg>\n</svg>"),
+			expected: "image/svg+xml"},
+		{name: "other xml", data: []byte(`<?xml version="1.0"?><svgish/>`), expected: "text/xml; charset=utf-8"},
+		{name: "text", data: []byte("hello world"), expected: "text/plain; charset=utf-8"},
+	}
+
+	var testTools Tools
+
+	for _, e := range detectTests {
+		if got := testTools.DetectContentType(e.data); got != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestExtensionMatches(t *testing.T) {
+	var extensionTests = []struct {
+		fileType string
+		ext      string
+		expected bool
+	}{
+		{"image/jpeg", ".jpg", true},
+		{"image/jpeg", ".JPEG", true},
+		{"image/jpeg", ".png", false},
+		{"image/png", ".jpg", false},
+		{"application/octet-stream", ".jpg", false},
+		{"text/plain; charset=utf-8", ".csv", true},
+		{"text/plain; charset=utf-8", ".pdf", false},
+		{"application/zip", ".docx", true},
+		{"application/zip", ".zip", true},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx", true},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".xlsx", false},
+		{"image/heic", ".heic", true},
+		{"image/heif", ".heic", true},
+		{"video/mp4", "", true},
+	}
+
+	for _, e := range extensionTests {
+		if got := extensionMatches(e.fileType, e.ext); got != e.expected {
+			t.Errorf("%s %q: expected %v, got %v", e.fileType, e.ext, e.expected, got)
+		}
+	}
+}
+
+func TestTools_UploadDetectedTypes(t *testing.T) {
+	img := readTestImage(t)
+
+	var uploadTests = []struct {
+		name             string
+		fileName         string
+		content          []byte
+		allowedTypes     []string
+		verifyExtensions bool
+		expectedExt      string
+		expectedErr      error
+	}{
+		{name: "wildcard allows image", fileName: "photo.jpg", content: img,
+			allowedTypes: []string{"image/*"}, expectedExt: ".jpg"},
+		{name: "wildcard rejects text", fileName: "notes.txt", content: []byte("hello"),
+			allowedTypes: []string{"image/*"}, expectedErr: ErrFileTypeNotAllowed},
+		{name: "wildcard rejects svg", fileName: "logo.svg", content: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`),
+			allowedTypes: []string{"image/*"}, expectedErr: ErrFileTypeNotAllowed},
+		{name: "any type rejects svg", fileName: "logo.svg", content: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`),
+			allowedTypes: []string{"*/*"}, expectedErr: ErrFileTypeNotAllowed},
+		{name: "text wildcard rejects html", fileName: "page.html", content: []byte("<html><script>alert(1)</script>"),
+			allowedTypes: []string{"text/*"}, expectedErr: ErrFileTypeNotAllowed},
+		{name: "text wildcard rejects xml", fileName: "feed.xml", content: []byte(`<?xml version="1.0"?><feed/>`),
+			allowedTypes: []string{"text/*"}, expectedErr: ErrFileTypeNotAllowed},
+		{name: "svg allowed by name", fileName: "logo.svg", content: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`),
+			allowedTypes: []string{"image/*", "image/svg+xml"}, expectedExt: ".svg"},
+		{name: "type without parameters", fileName: "notes.txt", content: []byte("hello"),
+			allowedTypes: []string{"text/plain"}, expectedExt: ".txt"},
+		{name: "alternative extension is kept", fileName: "photo.JPEG", content: img,
+			expectedExt: ".jpeg"},
+		{name: "extension from content", fileName: "photo", content: img,
+			expectedExt: ".jpg"},
+		{name: "wrong extension replaced", fileName: "photo.png", content: img,
+			expectedExt: ".jpg"},
+		{name: "html name on plain text", fileName: "x.html",
+			content:      append(bytes.Repeat([]byte(" "), 600), "<script>alert(1)</script>"...),
+			allowedTypes: []string{"text/plain"}, expectedExt: ".txt"},
+		{name: "svg name on plain text", fileName: "x.svg",
+			content:      append(bytes.Repeat([]byte("notes "), 100), "<svg onload=alert(1)>"...),
+			allowedTypes: []string{"text/plain"}, expectedExt: ".txt"},
+		{name: "unclaimed extension kept", fileName: "notes.csv", content: []byte("a,b"),
+			allowedTypes: []string{"text/plain"}, expectedExt: ".csv"},
+		{name: "wrong extension rejected", fileName: "photo.png", content: img,
+			verifyExtensions: true, expectedErr: ErrExtensionMismatch},
+		{name: "script disguised as image", fileName: "evil.jpg", content: []byte("#!/bin/sh\nrm -rf /"),
+			verifyExtensions: true, expectedErr: ErrExtensionMismatch},
+		{name: "office document", fileName: "report.docx",
+			content: newTestZip(t, testArchiveEntry{name: "[Content_Types].xml"},
+				testArchiveEntry{name: "word/document.xml"}),
+			verifyExtensions: true, expectedExt: ".docx"},
+	}
+
+	for _, e := range uploadTests {
+		testTools := Tools{AllowedFileTypes: e.allowedTypes, VerifyExtensions: e.verifyExtensions}
+
+		uploadedFile, err := testTools.UploadOneFile(
+			newUploadRequest(t, testFormFile{"file", e.fileName, e.content}), t.TempDir())
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if ext := filepath.Ext(uploadedFile.NewFileName); ext != e.expectedExt {
+			t.Errorf("%s: expected stored extension %q, got %q", e.name, e.expectedExt, ext)
+		}
+	}
+}
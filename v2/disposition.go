@@ -0,0 +1,104 @@
+package toolkit
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type DispositionType int
+
+const (
+	DispositionAttachment DispositionType = iota
+	DispositionInline
+)
+
+func (d DispositionType) String() string {
+	if d == DispositionInline {
+		return "inline"
+	}
+	return "attachment"
+}
+
+// ContentDisposition builds a Content-Disposition header value as described
+// in RFC 6266. Control characters are dropped from name. Names that are not
+// plain ASCII get an ASCII fallback in filename, with accents removed and
+// other characters replaced, and the full UTF-8 name in filename* as defined
+// by RFC 5987.
+func ContentDisposition(disposition DispositionType, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(name, ""))
+
+	if name == "" {
+		return disposition.String()
+	}
+
+	var b strings.Builder
+	b.WriteString(disposition.String())
+
+	fallback := asciiFileName(name)
+	b.WriteString(`; filename="`)
+	for i := 0; i < len(fallback); i++ {
+		if c := fallback[i]; c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(fallback[i])
+	}
+	b.WriteByte('"')
+
+	if fallback != name {
+		b.WriteString("; filename*=UTF-8''")
+		b.WriteString(encodeExtValue(name))
+	}
+
+	return b.String()
+}
+
+// asciiFileName turns name into printable ASCII for clients that do not
+// understand filename*. Percent signs are replaced as well, because some
+// browsers decode percent escapes in filename.
+func asciiFileName(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r == '%' || r >= utf8.RuneSelf:
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// encodeExtValue percent-encodes every byte of s that is not an attr-char.
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0F])
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
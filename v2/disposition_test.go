@@ -0,0 +1,50 @@
+package toolkit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	var dispositionTests = []struct {
+		name        string
+		disposition DispositionType
+		fileName    string
+		expected    string
+	}{
+		{name: "ascii", fileName: "report.pdf", expected: `attachment; filename="report.pdf"`},
+		{name: "inline", disposition: DispositionInline, fileName: "photo.jpg",
+			expected: `inline; filename="photo.jpg"`},
+		{name: "empty", expected: "attachment"},
+		{name: "quotes", fileName: `say "hi"\.txt`, expected: `attachment; filename="say \"hi\"\\.txt"`},
+		{name: "header injection", fileName: "a\r\nSet-Cookie: x=1.txt",
+			expected: `attachment; filename="aSet-Cookie: x=1.txt"`},
+		{name: "accents", fileName: "résumé.pdf",
+			expected: `attachment; filename="resume.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{name: "cyrillic", fileName: "отчёт.docx",
+			expected: `attachment; filename="_____.docx"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.docx`},
+		{name: "cjk", fileName: "报告 1.txt",
+			expected: `attachment; filename="__ 1.txt"; filename*=UTF-8''%E6%8A%A5%E5%91%8A%201.txt`},
+		{name: "percent", fileName: "100%.txt",
+			expected: `attachment; filename="100_.txt"; filename*=UTF-8''100%25.txt`},
+	}
+
+	for _, e := range dispositionTests {
+		if got := ContentDisposition(e.disposition, e.fileName); got != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestTools_DownloadStaticFileInline(t *testing.T) {
+	testTools := Tools{Disposition: DispositionInline}
+
+	rr := httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, httptest.NewRequest("GET", "/", nil),
+		"./testdata/image.jpg", "фото.jpg")
+
+	expected := `inline; filename="____.jpg"; filename*=UTF-8''%D1%84%D0%BE%D1%82%D0%BE.jpg`
+	if got := rr.Header().Get("Content-Disposition"); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
@@ -0,0 +1,231 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DownloadRoot serves files from a single directory or file system. Names
+// that leave it, refer to a hidden file or directory, or do not name a
+// regular file all get a 404, so a client cannot learn whether anything
+// exists behind them.
+type DownloadRoot struct {
+	// ModTime stands in for the modification time of files that have none,
+	// such as those in an embed.FS, so clients can still revalidate them.
+	ModTime time.Time
+
+	t    *Tools
+	fsys fs.FS
+	dir  string
+}
+
+// NewDownloadRoot serves the files under dir. Symbolic links are followed as
+// long as they resolve to a path inside dir.
+func (t *Tools) NewDownloadRoot(dir string) *DownloadRoot {
+	return &DownloadRoot{t: t, fsys: os.DirFS(dir), dir: dir}
+}
+
+// NewDownloadFS serves the files in fsys, which is trusted to keep names
+// inside itself.
+func (t *Tools) NewDownloadFS(fsys fs.FS) *DownloadRoot {
+	return &DownloadRoot{t: t, fsys: fsys}
+}
+
+// ServeHTTP serves the file named by the request path.
+func (d *DownloadRoot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.Download(w, r, r.URL.Path, "")
+}
+
+// Download sends the file at name, a slash-separated path relative to the
+// root, under displayName or its own base name. Files are decrypted, sidecars
+// consulted and expired uploads refused as in DownloadStaticFile; files that
+// were never encrypted, such as embedded assets, are sent as they are.
+func (d *DownloadRoot) Download(w http.ResponseWriter, r *http.Request, name, displayName string) {
+	name = strings.TrimPrefix(name, "/")
+
+	file, err := d.openContent(r.Context(), name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	if record := d.record(r.Context(), name); record != nil {
+		if record.expired() {
+			http.NotFound(w, r)
+			return
+		}
+		if d.t.Sidecars {
+			if displayName == "" {
+				displayName = d.t.SanitizeFileName(record.OriginalFileName)
+			}
+			if record.ContentType != "" {
+				w.Header().Set("Content-Type", record.ContentType)
+			}
+		}
+	}
+	if displayName == "" {
+		displayName = path.Base(name)
+	}
+
+	w.Header().Set("Content-Disposition", ContentDisposition(d.t.Disposition, displayName))
+	serveContent(w, r, path.Base(name), file.size, file.modTime, file.content)
+}
+
+// rootFile is a file opened for download, decrypted if need be.
+type rootFile struct {
+	f       fs.File
+	content io.Reader
+	size    int64
+	modTime time.Time
+}
+
+func (rf *rootFile) Close() error {
+	return rf.f.Close()
+}
+
+func (d *DownloadRoot) openContent(ctx context.Context, name string) (*rootFile, error) {
+	f, info, err := d.open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rf := &rootFile{f: f, content: fileContent(f, info), size: info.Size(), modTime: info.ModTime()}
+	if rf.modTime.IsZero() {
+		rf.modTime = d.ModTime
+	}
+	if d.t.Encryption == nil {
+		return rf, nil
+	}
+
+	dec, err := (&encryptedStorage{opts: d.t.Encryption}).newDecryptReader(ctx,
+		struct {
+			io.Reader
+			io.Closer
+		}{rf.content, f})
+	switch {
+	case err == nil && dec.rs != nil:
+		rf.content, rf.size = &seekableDecryptReader{dec}, dec.size
+	case err == nil:
+		rf.content, rf.size = dec, -1
+	case errors.Is(err, ErrNotEncrypted):
+		f.Close()
+		if f, info, err = d.open(name); err != nil {
+			return nil, err
+		}
+		rf.f, rf.content = f, fileContent(f, info)
+	default:
+		f.Close()
+		return nil, err
+	}
+	return rf, nil
+}
+
+// fileContent returns f in a form http.ServeContent can use when possible.
+func fileContent(f fs.File, info fs.FileInfo) io.Reader {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs
+	}
+	if ra, ok := f.(io.ReaderAt); ok {
+		return io.NewSectionReader(ra, 0, info.Size())
+	}
+	return f
+}
+
+func (d *DownloadRoot) open(name string) (fs.File, fs.FileInfo, error) {
+	if !downloadName(name) {
+		return nil, nil, notExist(name)
+	}
+	if d.dir != "" {
+		resolved, err := d.resolve(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		name = resolved
+	}
+
+	f, err := d.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = notExist(name)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// resolve follows the symbolic links in name and returns the path of the file
+// it refers to relative to the root directory. It fails when that file lies
+// outside the root or is hidden.
+func (d *DownloadRoot) resolve(name string) (string, error) {
+	root, err := filepath.EvalSymlinks(d.dir)
+	if err != nil {
+		return "", err
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if !downloadName(rel) {
+		return "", notExist(name)
+	}
+	return rel, nil
+}
+
+func (d *DownloadRoot) record(ctx context.Context, name string) *FileRecord {
+	dir, base := path.Split(name)
+
+	f, err := d.fsys.Open(path.Join(dir, sidecarName(base)))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var content io.Reader = f
+	if d.t.Encryption != nil {
+		dec, err := (&encryptedStorage{opts: d.t.Encryption}).newDecryptReader(ctx, f)
+		if err != nil {
+			return nil
+		}
+		content = dec
+	}
+
+	record, err := decodeRecord(content)
+	if err != nil {
+		return nil
+	}
+	return record
+}
+
+// downloadName reports whether name is a clean relative path that stays in
+// the root and has no hidden elements.
+func downloadName(name string) bool {
+	if !fs.ValidPath(name) || name == "." || strings.ContainsAny(name, "\\\x00") {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+package toolkit
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestDownloadRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	outside := t.TempDir()
+
+	files := map[string]string{
+		"report.txt":            "report",
+		"docs/guide.txt":        "guide",
+		".env":                  "secret",
+		".hidden/file.txt":      "hidden",
+		"docs/.meta.txt":        "meta",
+		sidecarName("data.bin"): `{"original_file_name":"données.csv","content_type":"text/csv"}`,
+		"data.bin":              "a,b",
+	}
+	for name, content := range files {
+		fp := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fp), 0755)
+		if err := os.WriteFile(fp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(outside, "passwd"), []byte("root:x:0:0"), 0644)
+
+	symlinks := map[string]string{
+		"escape.txt": filepath.Join(outside, "passwd"),
+		"escape-dir": outside,
+		"inside.txt": filepath.Join(root, "report.txt"),
+		"env.txt":    filepath.Join(root, ".env"),
+	}
+	for name, target := range symlinks {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip("symlinks are not supported:", err)
+		}
+	}
+
+	var downloadTests = []struct {
+		name     string
+		path     string
+		status   int
+		body     string
+		fileName string
+	}{
+		{name: "file", path: "/report.txt", status: http.StatusOK, body: "report",
+			fileName: `attachment; filename="report.txt"`},
+		{name: "nested", path: "/docs/guide.txt", status: http.StatusOK, body: "guide"},
+		{name: "symlink inside", path: "/inside.txt", status: http.StatusOK, body: "report"},
+		{name: "sidecar name", path: "/data.bin", status: http.StatusOK, body: "a,b",
+			fileName: `attachment; filename="donnees.csv"; filename*=UTF-8''donn%C3%A9es.csv`},
+		{name: "traversal", path: "/../passwd", status: http.StatusNotFound},
+		{name: "nested traversal", path: "/docs/../../passwd", status: http.StatusNotFound},
+		{name: "dot segment", path: "/docs/../report.txt", status: http.StatusNotFound},
+		{name: "backslash", path: `/..\passwd`, status: http.StatusNotFound},
+		{name: "symlink escape", path: "/escape.txt", status: http.StatusNotFound},
+		{name: "symlink dir escape", path: "/escape-dir/passwd", status: http.StatusNotFound},
+		{name: "symlink to hidden", path: "/env.txt", status: http.StatusNotFound},
+		{name: "hidden file", path: "/.env", status: http.StatusNotFound},
+		{name: "hidden dir", path: "/.hidden/file.txt", status: http.StatusNotFound},
+		{name: "nested hidden", path: "/docs/.meta.txt", status: http.StatusNotFound},
+		{name: "sidecar", path: "/" + sidecarName("data.bin"), status: http.StatusNotFound},
+		{name: "directory", path: "/docs", status: http.StatusNotFound},
+		{name: "root", path: "/", status: http.StatusNotFound},
+		{name: "missing", path: "/missing.txt", status: http.StatusNotFound},
+	}
+
+	testTools := Tools{Sidecars: true}
+	dr := testTools.NewDownloadRoot(root)
+
+	for _, e := range downloadTests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		dr.Download(rr, req, e.path, "")
+
+		if rr.Code != e.status {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.status, rr.Code)
+			continue
+		}
+		if e.body != "" && rr.Body.String() != e.body {
+			t.Errorf("%s: expected body %q, got %q", e.name, e.body, rr.Body.String())
+		}
+		if e.fileName != "" && rr.Header().Get("Content-Disposition") != e.fileName {
+			t.Errorf("%s: expected disposition %s, got %s", e.name, e.fileName,
+				rr.Header().Get("Content-Disposition"))
+		}
+	}
+}
+
+func TestDownloadRoot_FS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"static/app.js": {Data: []byte("console.log(1)")},
+		".git/config":   {Data: []byte("[core]")},
+	}
+
+	var testTools Tools
+	dr := testTools.NewDownloadFS(fsys)
+
+	for path, status := range map[string]int{
+		"/static/app.js":     http.StatusOK,
+		"/.git/config":       http.StatusNotFound,
+		"/../static/app.js":  http.StatusNotFound,
+		"/static/missing.js": http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		dr.ServeHTTP(rr, &http.Request{Method: "GET", URL: &url.URL{Path: path}})
+		if rr.Code != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, rr.Code)
+		}
+	}
+}
+
+//go:embed testdata/image.jpg
+var testEmbedFS embed.FS
+
+// streamFS hides everything but Read from the files of a file system.
+type streamFS struct {
+	fs.FS
+}
+
+type streamFile struct {
+	f fs.File
+}
+
+func (s streamFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return streamFile{f}, nil
+}
+
+func (f streamFile) Read(p []byte) (int, error) { return f.f.Read(p) }
+func (f streamFile) Stat() (fs.FileInfo, error) { return f.f.Stat() }
+func (f streamFile) Close() error               { return f.f.Close() }
+
+func TestTools_DownloadFS(t *testing.T) {
+	image := readTestImage(t)
+	modTime := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	later := modTime.Add(time.Hour).Format(http.TimeFormat)
+
+	mapFS := fstest.MapFS{"image.jpg": {Data: image, ModTime: modTime}}
+
+	var fsTests = []struct {
+		name     string
+		fsys     fs.FS
+		path     string
+		header   map[string]string
+		status   int
+		body     []byte
+		encrypt  bool
+		rootTime bool
+	}{
+		{name: "embed", fsys: testEmbedFS, path: "testdata/image.jpg", status: http.StatusOK, body: image},
+		{name: "embed range", fsys: testEmbedFS, path: "testdata/image.jpg",
+			header: map[string]string{"Range": "bytes=0-9"}, status: http.StatusPartialContent, body: image[:10]},
+		{name: "embed not modified", fsys: testEmbedFS, path: "testdata/image.jpg", rootTime: true,
+			header: map[string]string{"If-Modified-Since": later}, status: http.StatusNotModified},
+		{name: "embed unencrypted", fsys: testEmbedFS, path: "testdata/image.jpg", encrypt: true,
+			status: http.StatusOK, body: image},
+		{name: "modified", fsys: mapFS, path: "image.jpg",
+			header: map[string]string{"If-Modified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)},
+			status: http.StatusOK, body: image},
+		{name: "not modified", fsys: mapFS, path: "image.jpg",
+			header: map[string]string{"If-Modified-Since": later}, status: http.StatusNotModified},
+		{name: "stream", fsys: streamFS{mapFS}, path: "image.jpg",
+			header: map[string]string{"Range": "bytes=0-9"}, status: http.StatusOK, body: image},
+		{name: "stream not modified", fsys: streamFS{mapFS}, path: "image.jpg",
+			header: map[string]string{"If-Modified-Since": later}, status: http.StatusNotModified},
+		{name: "dot segment", fsys: testEmbedFS, path: "testdata/../testdata/image.jpg", status: http.StatusNotFound},
+	}
+
+	for _, e := range fsTests {
+		var testTools Tools
+		if e.encrypt {
+			testTools.Encryption = &EncryptionOptions{Keys: testKeys()}
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		for k, v := range e.header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+
+		if e.rootTime {
+			dr := testTools.NewDownloadFS(e.fsys)
+			dr.ModTime = modTime
+			dr.Download(rr, req, e.path, "photo.jpg")
+		} else {
+			testTools.DownloadFS(rr, req, e.fsys, e.path, "photo.jpg")
+		}
+
+		if rr.Code != e.status {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.status, rr.Code)
+			continue
+		}
+		if e.body != nil && !bytes.Equal(rr.Body.Bytes(), e.body) {
+			t.Errorf("%s: wrong body of %d bytes", e.name, rr.Body.Len())
+		}
+		if e.status == http.StatusOK && rr.Header().Get("Content-Disposition") != `attachment; filename="photo.jpg"` {
+			t.Errorf("%s: wrong disposition %s", e.name, rr.Header().Get("Content-Disposition"))
+		}
+	}
+}
+
+func TestTools_DownloadContent(t *testing.T) {
+	modTime := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	testTools := Tools{Disposition: DispositionInline}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=4-8")
+	rr := httptest.NewRecorder()
+	testTools.DownloadContent(rr, req, "notes.txt", modTime,
+		strings.NewReader("the quick brown fox"), "")
+
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "quick" {
+		t.Errorf("expected partial content %q, got %d %q", "quick", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Disposition"); got != `inline; filename="notes.txt"` {
+		t.Errorf("wrong disposition %s", got)
+	}
+	if got := rr.Header().Get("Last-Modified"); got != modTime.Format(http.TimeFormat) {
+		t.Errorf("wrong last modified %s", got)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+	rr = httptest.NewRecorder()
+	testTools.DownloadContent(rr, req, "notes.txt", modTime,
+		strings.NewReader("the quick brown fox"), "")
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected not modified, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,523 @@
+package toolkit
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	encryptionMagic     = "GTKENC"
+	encryptionVersion   = 1
+	encryptionSaltLen   = 32
+	encryptionPrefixLen = len(encryptionMagic) + 1 + 4 + encryptionSaltLen + 1
+	defaultChunkSize    = 64 << 10
+	maxChunkSize        = 16 << 20
+	gcmTagLen           = 16
+)
+
+var (
+	ErrInvalidKey           = errors.New("the encryption key must be 32 bytes")
+	ErrUnknownKey           = errors.New("the encryption key is not available")
+	ErrNotEncrypted         = errors.New("the stored file is not encrypted")
+	ErrEncryptedFileCorrupt = errors.New("the encrypted file is corrupt or has been tampered with")
+)
+
+// KeyProvider supplies the AES-256 keys used to encrypt uploads at rest.
+// CurrentKey is used for new files and its ID is stored in their header, so
+// files written under a previous key can still be read through Key after the
+// current key is rotated.
+type KeyProvider interface {
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider backed by a fixed set of keys.
+type StaticKeys struct {
+	CurrentID string
+	Keys      map[string][]byte
+}
+
+func (s *StaticKeys) CurrentKey(ctx context.Context) (string, []byte, error) {
+	key, err := s.Key(ctx, s.CurrentID)
+	return s.CurrentID, key, err
+}
+
+func (s *StaticKeys) Key(ctx context.Context, id string) ([]byte, error) {
+	key, ok := s.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// EncryptionOptions turns on encryption at rest for everything the toolkit
+// stores: uploads, image variants and sidecars. Files are encrypted with
+// AES-256-GCM in chunks of ChunkSize bytes, 64KB by default, under a key
+// derived per file, so they can be of any size and still be read from any
+// offset. Storage.List keeps reporting encrypted sizes, and partial tus
+// uploads are only encrypted once they complete.
+type EncryptionOptions struct {
+	Keys      KeyProvider
+	ChunkSize int
+}
+
+// encryptedStorage encrypts files on their way into the underlying storage
+// and decrypts them on their way out.
+//
+// A file starts with a header holding the magic, format version, chunk size,
+// a random salt and the key ID, followed by the sealed chunks. Every chunk
+// but the last is full; the chunk index and a final chunk flag make up the
+// nonce, and the header is authenticated with every chunk, so chunks cannot be
+// reordered, dropped or moved between files.
+type encryptedStorage struct {
+	Storage
+	opts *EncryptionOptions
+}
+
+type encryptionHeader struct {
+	raw       []byte
+	chunkSize int
+	salt      []byte
+	keyID     string
+}
+
+func (e *encryptedStorage) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	id, key, err := e.opts.Keys.CurrentKey(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	chunkSize := e.opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	enc, err := newEncryptReader(r, id, key, min(chunkSize, maxChunkSize))
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := e.Storage.Put(ctx, name, enc); err != nil {
+		return 0, err
+	}
+	return enc.size, nil
+}
+
+func (e *encryptedStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	content, err := e.Storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := e.newDecryptReader(ctx, content)
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	if d.rs != nil {
+		return &seekableDecryptReader{d}, nil
+	}
+	return d, nil
+}
+
+// Stat reports the size of the decrypted file, which takes reading its
+// header.
+func (e *encryptedStorage) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	info, err := e.Storage.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := e.Storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	hdr, err := readEncryptionHeader(content)
+	if err != nil {
+		return nil, err
+	}
+	size, err := hdr.plainSize(info.Size - int64(len(hdr.raw)))
+	if err != nil {
+		return nil, err
+	}
+
+	plain := *info
+	plain.Size = size
+	return &plain, nil
+}
+
+// Rename moves the encrypted file as it is, without decrypting it.
+func (e *encryptedStorage) Rename(ctx context.Context, oldName, newName string) error {
+	return moveStored(ctx, e.Storage, oldName, newName)
+}
+
+func fileAEAD(key, salt []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	fileKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(encryptionMagic)), fileKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(nonce []byte, index uint64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce, index)
+	nonce[8], nonce[9], nonce[10], nonce[11] = 0, 0, 0, 0
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func readEncryptionHeader(r io.Reader) (*encryptionHeader, error) {
+	prefix := make([]byte, encryptionPrefixLen)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if string(prefix[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, ErrNotEncrypted
+	}
+
+	rest := prefix[len(encryptionMagic):]
+	if rest[0] != encryptionVersion {
+		return nil, ErrEncryptedFileCorrupt
+	}
+	chunkSize := int(binary.BigEndian.Uint32(rest[1:5]))
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return nil, ErrEncryptedFileCorrupt
+	}
+
+	keyID := make([]byte, rest[5+encryptionSaltLen])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, ErrEncryptedFileCorrupt
+	}
+
+	return &encryptionHeader{
+		raw:       append(prefix, keyID...),
+		chunkSize: chunkSize,
+		salt:      rest[5 : 5+encryptionSaltLen],
+		keyID:     string(keyID),
+	}, nil
+}
+
+// plainSize works out the decrypted size from the size of the sealed chunks.
+func (h *encryptionHeader) plainSize(sealed int64) (int64, error) {
+	sealedChunk := int64(h.chunkSize + gcmTagLen)
+	if sealed < gcmTagLen {
+		return 0, ErrEncryptedFileCorrupt
+	}
+
+	full := (sealed - gcmTagLen) / sealedChunk
+	last := sealed - gcmTagLen - full*sealedChunk
+	if last > int64(h.chunkSize) {
+		return 0, ErrEncryptedFileCorrupt
+	}
+	return full*int64(h.chunkSize) + last, nil
+}
+
+type encryptReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	index  uint64
+
+	// pending holds the plaintext read ahead. One byte more than a chunk is
+	// read so a full chunk is only sealed as the last one at the very end.
+	pending []byte
+	sealed  []byte
+	out     []byte
+	done    bool
+	err     error
+	size    int64
+}
+
+func newEncryptReader(src io.Reader, keyID string, key []byte, chunkSize int) (*encryptReader, error) {
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("toolkit: encryption key ID %q is too long", keyID)
+	}
+
+	header := make([]byte, 0, encryptionPrefixLen+len(keyID))
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(chunkSize))
+
+	salt := make([]byte, encryptionSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+
+	aead, err := fileAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		src:     src,
+		aead:    aead,
+		header:  header,
+		nonce:   make([]byte, aead.NonceSize()),
+		pending: make([]byte, 0, chunkSize+1),
+		sealed:  make([]byte, 0, chunkSize+gcmTagLen),
+		out:     header,
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		if e.done {
+			return 0, io.EOF
+		}
+		e.err = e.seal()
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) seal() error {
+	chunkSize := cap(e.pending) - 1
+
+	n, err := io.ReadFull(e.src, e.pending[len(e.pending):cap(e.pending)])
+	e.pending = e.pending[:len(e.pending)+n]
+	e.size += int64(n)
+
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	chunk := e.pending
+	if !last {
+		chunk = e.pending[:chunkSize]
+	}
+	e.out = e.aead.Seal(e.sealed[:0], chunkNonce(e.nonce, e.index, last), chunk, e.header)
+	e.index++
+
+	if last {
+		e.done = true
+		return nil
+	}
+	e.pending = e.pending[:copy(e.pending, e.pending[chunkSize:])]
+	return nil
+}
+
+type decryptReader struct {
+	src    io.ReadCloser
+	rs     io.ReadSeeker
+	br     *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+
+	chunkSize int
+	sealed    []byte
+	buf       []byte
+	plain     []byte
+	index     uint64
+	done      bool
+	err       error
+
+	// size and pos are only tracked for seekable sources. A seek just
+	// records the new position; stale makes the next read find its chunk.
+	size  int64
+	pos   int64
+	stale bool
+}
+
+func (e *encryptedStorage) newDecryptReader(ctx context.Context, src io.ReadCloser) (*decryptReader, error) {
+	hdr, err := readEncryptionHeader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := e.opts.Keys.Key(ctx, hdr.keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(key, hdr.salt)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptReader{
+		src:       src,
+		br:        bufio.NewReaderSize(src, hdr.chunkSize+gcmTagLen),
+		aead:      aead,
+		header:    hdr.raw,
+		nonce:     make([]byte, aead.NonceSize()),
+		chunkSize: hdr.chunkSize,
+		sealed:    make([]byte, hdr.chunkSize+gcmTagLen),
+		buf:       make([]byte, 0, hdr.chunkSize),
+	}
+
+	if rs, ok := src.(io.ReadSeeker); ok {
+		end, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if d.size, err = hdr.plainSize(end - int64(len(hdr.raw))); err != nil {
+			return nil, err
+		}
+		if _, err := rs.Seek(int64(len(hdr.raw)), io.SeekStart); err != nil {
+			return nil, err
+		}
+		d.rs = rs
+	}
+
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.stale {
+		d.stale = false
+		d.err = d.reposition()
+	}
+
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.br, d.sealed)
+
+	last := false
+	switch err {
+	case nil:
+		// A full chunk is the last one only when nothing follows it.
+		if _, err := d.br.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		// The last chunk is always present, even for an empty file.
+		return ErrEncryptedFileCorrupt
+	default:
+		return err
+	}
+
+	d.plain, err = d.aead.Open(d.buf[:0], chunkNonce(d.nonce, d.index, last), d.sealed[:n], d.header)
+	if err != nil {
+		return ErrEncryptedFileCorrupt
+	}
+	d.index++
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) reposition() error {
+	d.plain = nil
+	if d.pos >= d.size {
+		d.done = true
+		return nil
+	}
+
+	index := d.pos / int64(d.chunkSize)
+	offset := int64(len(d.header)) + index*int64(d.chunkSize+gcmTagLen)
+	if _, err := d.rs.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	d.br.Reset(d.rs)
+	d.index = uint64(index)
+	d.done = false
+
+	if err := d.open(); err != nil {
+		return err
+	}
+	d.plain = d.plain[d.pos-index*int64(d.chunkSize):]
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
+
+// seekableDecryptReader is returned for sources that can seek, which lets
+// http.ServeContent answer range requests and archive/zip read entries
+// without decrypting the whole file.
+type seekableDecryptReader struct {
+	*decryptReader
+}
+
+func (d *seekableDecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("toolkit: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("toolkit: negative position")
+	}
+
+	d.pos = offset
+	d.plain = nil
+	d.err = nil
+	d.stale = true
+	return offset, nil
+}
+
+func (d *seekableDecryptReader) ReadAt(p []byte, off int64) (int, error) {
+	pos := d.pos
+	defer d.Seek(pos, io.SeekStart)
+
+	if _, err := d.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(d.decryptReader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,264 @@
+package toolkit
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeys() *StaticKeys {
+	return &StaticKeys{
+		CurrentID: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	testStorage(t, "encrypted disk", &encryptedStorage{
+		Storage: &DiskStorage{Root: t.TempDir()},
+		opts:    &EncryptionOptions{Keys: testKeys(), ChunkSize: 4},
+	})
+	testStorage(t, "encrypted memory", &encryptedStorage{
+		Storage: NewMemoryStorage(),
+		opts:    &EncryptionOptions{Keys: testKeys()},
+	})
+}
+
+func TestEncryptedStorage_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	base := &DiskStorage{Root: t.TempDir()}
+	s := &encryptedStorage{Storage: base, opts: &EncryptionOptions{Keys: testKeys(), ChunkSize: 16}}
+
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 33, 100} {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i)
+		}
+
+		n, err := s.Put(ctx, "file", bytes.NewReader(content))
+		if err != nil || n != int64(size) {
+			t.Fatalf("size %d: put returned %d, %v", size, n, err)
+		}
+
+		raw, _ := os.ReadFile(filepath.Join(base.Root, "file"))
+		if size >= 15 && bytes.Contains(raw, content) {
+			t.Errorf("size %d: plaintext found in stored file", size)
+		}
+
+		info, err := s.Stat(ctx, "file")
+		if err != nil || info.Size != int64(size) {
+			t.Errorf("size %d: stat returned %+v, %v", size, info, err)
+		}
+
+		rc, err := s.Get(ctx, "file")
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		data, err := io.ReadAll(rc)
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("size %d: read back %v, %v", size, data, err)
+		}
+
+		// Reads at every offset cross chunk boundaries in every possible way.
+		ra := rc.(io.ReaderAt)
+		for off := 0; off < size; off++ {
+			buf := make([]byte, min(20, size-off))
+			if _, err := ra.ReadAt(buf, int64(off)); err != nil && err != io.EOF {
+				t.Fatalf("size %d: ReadAt %d: %v", size, off, err)
+			}
+			if !bytes.Equal(buf, content[off:off+len(buf)]) {
+				t.Errorf("size %d: ReadAt %d returned %v", size, off, buf)
+			}
+		}
+
+		rs := rc.(io.ReadSeeker)
+		if end, err := rs.Seek(0, io.SeekEnd); err != nil || end != int64(size) {
+			t.Errorf("size %d: seek to end returned %d, %v", size, end, err)
+		}
+		if n, err := rs.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("size %d: expected EOF at end, got %d, %v", size, n, err)
+		}
+		rc.Close()
+	}
+}
+
+func TestEncryptedStorage_Errors(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeys()
+	base := NewMemoryStorage()
+	s := &encryptedStorage{Storage: base, opts: &EncryptionOptions{Keys: keys, ChunkSize: 16}}
+
+	content := bytes.Repeat([]byte("secret "), 10)
+	if _, err := s.Put(ctx, "old", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating the current key leaves older files readable.
+	keys.CurrentID = "k2"
+	if _, err := s.Put(ctx, "new", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := func(name string) []byte {
+		rc, _ := base.Get(ctx, name)
+		defer rc.Close()
+		data, _ := io.ReadAll(rc)
+		return data
+	}
+	if !bytes.Contains(raw("old"), []byte("k1")) || !bytes.Contains(raw("new"), []byte("k2")) {
+		t.Error("expected the key IDs in the file headers")
+	}
+
+	tampered := raw("old")
+	tampered[len(tampered)-20] ^= 1
+	base.Put(ctx, "tampered", bytes.NewReader(tampered))
+
+	truncated := raw("old")
+	base.Put(ctx, "truncated", bytes.NewReader(truncated[:len(truncated)-32]))
+
+	base.Put(ctx, "plain", bytes.NewReader(content))
+
+	delete(keys.Keys, "k1")
+
+	var errorTests = []struct {
+		name        string
+		expectedErr error
+	}{
+		{name: "new", expectedErr: nil},
+		{name: "old", expectedErr: ErrUnknownKey},
+		{name: "tampered", expectedErr: ErrUnknownKey},
+		{name: "plain", expectedErr: ErrNotEncrypted},
+	}
+
+	for _, e := range errorTests {
+		_, err := readAllStored(ctx, s, e.name)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+	}
+
+	keys.Keys["k1"] = bytes.Repeat([]byte{1}, 32)
+	for _, name := range []string{"tampered", "truncated"} {
+		if _, err := readAllStored(ctx, s, name); !errors.Is(err, ErrEncryptedFileCorrupt) {
+			t.Errorf("%s: expected error %v, got %v", name, ErrEncryptedFileCorrupt, err)
+		}
+	}
+}
+
+func readAllStored(ctx context.Context, s Storage, name string) ([]byte, error) {
+	rc, err := s.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestTools_EncryptedUpload(t *testing.T) {
+	uploadDir := t.TempDir()
+	text := []byte("the quick brown fox jumps over the lazy dog")
+
+	testTools := Tools{
+		Encryption:      &EncryptionOptions{Keys: testKeys(), ChunkSize: 8},
+		ExtractArchives: &ArchiveOptions{},
+		Sidecars:        true,
+	}
+
+	uploadedFile, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "fox.txt", text}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadedFile.FileSize != int64(len(text)) {
+		t.Errorf("expected size %d, got %d", len(text), uploadedFile.FileSize)
+	}
+
+	pathName := filepath.Join(uploadDir, uploadedFile.NewFileName)
+	raw, _ := os.ReadFile(pathName)
+	if bytes.Contains(raw, []byte("fox")) {
+		t.Error("expected the stored file to be encrypted")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=4-8")
+	rr := httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, req, pathName, "")
+
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "quick" {
+		t.Errorf("expected partial content %q, got %d %q", "quick", rr.Code, rr.Body.String())
+	}
+	if disposition := rr.Header().Get("Content-Disposition"); disposition != `attachment; filename="fox.txt"` {
+		t.Errorf("expected the original name from the encrypted sidecar, got %q", disposition)
+	}
+
+	// Archives are extracted from the encrypted staging copy.
+	files, err := testTools.UploadMultipleFiles(newUploadRequest(t, testFormFile{"file", "bundle.zip",
+		newTestZip(t, testArchiveEntry{name: "a.txt", content: text})}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].OriginalFileName != "a.txt" {
+		t.Fatalf("unexpected extracted files %+v", files)
+	}
+
+	content, err := readAllStored(context.Background(), testTools.storage(),
+		storageKey(uploadDir, files[0].NewFileName))
+	if err != nil || !bytes.Equal(content, text) {
+		t.Errorf("extracted file read back as %q, %v", content, err)
+	}
+}
+
+func TestTools_DownloadPlaintextEncrypted(t *testing.T) {
+	uploadDir := t.TempDir()
+	text := []byte("stored before encryption")
+	if err := os.WriteFile(filepath.Join(uploadDir, "old.txt"), text, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testTools := Tools{Encryption: &EncryptionOptions{Keys: testKeys()}}
+
+	downloads := map[string]func(w http.ResponseWriter, r *http.Request){
+		"static file": func(w http.ResponseWriter, r *http.Request) {
+			testTools.DownloadStaticFile(w, r, filepath.Join(uploadDir, "old.txt"), "")
+		},
+		"root": func(w http.ResponseWriter, r *http.Request) {
+			testTools.NewDownloadRoot(uploadDir).Download(w, r, "old.txt", "")
+		},
+	}
+	for name, download := range downloads {
+		rr := httptest.NewRecorder()
+		download(rr, httptest.NewRequest("GET", "/", nil))
+		if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), text) {
+			t.Errorf("%s: expected the plaintext file, got %d %q", name, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	err := testTools.DownloadZip(rr, httptest.NewRequest("GET", "/", nil), nil,
+		[]ZipFile{{Path: filepath.Join(uploadDir, "old.txt")}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if content, _ := io.ReadAll(rc); !bytes.Equal(content, text) {
+		t.Errorf("zip: expected the plaintext file, got %q", content)
+	}
+}
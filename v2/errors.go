@@ -0,0 +1,100 @@
+package toolkit
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrFileTooLarge        = errors.New("the uploaded file is too large")
+	ErrRequestTooLarge     = errors.New("the upload request is too large")
+	ErrFileTypeNotAllowed  = errors.New("the uploaded file type is not permitted")
+	ErrExtensionNotAllowed = errors.New("the uploaded file extension is not permitted")
+	ErrExtensionMismatch   = errors.New("the uploaded file extension does not match its content")
+	ErrTooManyFiles        = errors.New("too many files were uploaded")
+	ErrTooFewFiles         = errors.New("too few files were uploaded")
+	ErrMissingFile         = errors.New("a required file is missing")
+	ErrNoFiles             = errors.New("no files were uploaded")
+	ErrDigestMismatch      = errors.New("the uploaded file does not match the supplied digest")
+	ErrInvalidMultipart    = errors.New("the request is not a valid multipart form")
+	ErrInvalidImage        = errors.New("the uploaded image could not be decoded")
+	ErrImageTooLarge       = errors.New("the uploaded image dimensions are too large")
+	ErrFileExists          = errors.New("a file with the same name already exists")
+
+	ErrInvalidArchive        = errors.New("the uploaded archive could not be read")
+	ErrUnsafeArchiveEntry    = errors.New("the uploaded archive contains an unsafe entry")
+	ErrArchiveTooLarge       = errors.New("the uploaded archive is too large when extracted")
+	ErrCompressionRatio      = errors.New("the uploaded archive compression ratio is too high")
+	ErrTooManyArchiveEntries = errors.New("the uploaded archive contains too many entries")
+)
+
+type UploadError struct {
+	Err      error
+	Field    string
+	FileName string
+	FileType string
+	Limit    int64
+}
+
+func (e *UploadError) Error() string {
+	var b strings.Builder
+
+	if e.Field != "" {
+		fmt.Fprintf(&b, "field %q: ", e.Field)
+	}
+	if e.FileName != "" {
+		fmt.Fprintf(&b, "%s: ", e.FileName)
+	}
+
+	b.WriteString(e.Err.Error())
+
+	if e.FileType != "" {
+		fmt.Fprintf(&b, " (detected type %s)", e.FileType)
+	}
+	if e.Limit > 0 {
+		fmt.Fprintf(&b, " (limit %d)", e.Limit)
+	}
+
+	return b.String()
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UploadError) StatusCode() int {
+	switch {
+	case errors.Is(e.Err, ErrFileTooLarge), errors.Is(e.Err, ErrRequestTooLarge),
+		errors.Is(e.Err, ErrImageTooLarge), errors.Is(e.Err, ErrArchiveTooLarge),
+		errors.Is(e.Err, ErrCompressionRatio), errors.Is(e.Err, ErrTooManyArchiveEntries):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(e.Err, ErrFileTypeNotAllowed), errors.Is(e.Err, ErrExtensionNotAllowed),
+		errors.Is(e.Err, ErrExtensionMismatch):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(e.Err, ErrFileExists):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func (p *uploadPart) error(err error) *UploadError {
+	return &UploadError{Err: err, Field: p.field, FileName: p.fileName}
+}
+
+func uploadError(err error) error {
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesError):
+		return &UploadError{Err: ErrRequestTooLarge, Limit: maxBytesError.Limit}
+	case errors.Is(err, multipart.ErrMessageTooLarge):
+		return &UploadError{Err: ErrRequestTooLarge}
+	case errors.Is(err, http.ErrNotMultipart), errors.Is(err, http.ErrMissingBoundary):
+		return &UploadError{Err: ErrInvalidMultipart}
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadError(t *testing.T) {
+	var errorTests = []struct {
+		name           string
+		err            *UploadError
+		expectedStatus int
+		expectedMsg    string
+	}{
+		{name: "too large",
+			err:            &UploadError{Err: ErrFileTooLarge, Field: "file", FileName: "a.jpg", Limit: 10},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+			expectedMsg:    `field "file": a.jpg: the uploaded file is too large (limit 10)`},
+		{name: "type not allowed",
+			err:            &UploadError{Err: ErrFileTypeNotAllowed, FileName: "a.txt", FileType: "text/plain"},
+			expectedStatus: http.StatusUnsupportedMediaType,
+			expectedMsg:    "a.txt: the uploaded file type is not permitted (detected type text/plain)"},
+		{name: "file exists",
+			err:            &UploadError{Err: ErrFileExists, FileName: "a.txt"},
+			expectedStatus: http.StatusConflict,
+			expectedMsg:    "a.txt: a file with the same name already exists"},
+		{name: "no files",
+			err:            &UploadError{Err: ErrNoFiles},
+			expectedStatus: http.StatusBadRequest,
+			expectedMsg:    "no files were uploaded"},
+	}
+
+	for _, e := range errorTests {
+		if e.err.StatusCode() != e.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatus, e.err.StatusCode())
+		}
+		if e.err.Error() != e.expectedMsg {
+			t.Errorf("%s: wrong message %q", e.name, e.err.Error())
+		}
+	}
+}
+
+func TestTools_UploadErrorTypes(t *testing.T) {
+	img := readTestImage(t)
+
+	for _, stream := range []bool{false, true} {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, StreamUploads: stream}
+
+		_, err := testTools.UploadOneFile(
+			newUploadRequest(t, testFormFile{"avatar", "image.jpg", img}), t.TempDir())
+
+		var uploadErr *UploadError
+		if !errors.As(err, &uploadErr) {
+			t.Fatalf("expected UploadError, got %v", err)
+		}
+		if uploadErr.Field != "avatar" || uploadErr.FileName != "image.jpg" ||
+			uploadErr.FileType != "image/jpeg" {
+			t.Errorf("unexpected error details %+v", uploadErr)
+		}
+
+		request := httptest.NewRequest("POST", "/", strings.NewReader("not a form"))
+		request.Header.Set("Content-Type", "text/plain")
+		if _, err := testTools.UploadOneFile(request, t.TempDir()); !errors.Is(err, ErrInvalidMultipart) {
+			t.Errorf("stream %v: expected invalid multipart error, got %v", stream, err)
+		}
+
+		testTools.AllowedFileTypes = nil
+		if _, err := testTools.UploadOneFile(newUploadRequest(t), t.TempDir()); !errors.Is(err, ErrNoFiles) {
+			t.Errorf("stream %v: expected no files error, got %v", stream, err)
+		}
+	}
+}
+
+func TestTools_ErrorJSONUploadError(t *testing.T) {
+	var testTool Tools
+
+	rr := httptest.NewRecorder()
+
+	err := testTool.ErrorJSON(rr, &UploadError{Err: ErrFileTooLarge, FileName: "a.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", rr.Code)
+	}
+
+	var payload JSONResponse
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if !payload.Error || payload.Message != "a.jpg: the uploaded file is too large" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
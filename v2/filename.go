@@ -0,0 +1,144 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const defaultMaxFileNameLength = 255
+
+type CollisionPolicy int
+
+const (
+	CollisionOverwrite CollisionPolicy = iota
+	CollisionError
+	CollisionSuffix
+)
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName turns a client supplied file name into one that is safe to
+// use as a single path element on any common filesystem. Directory components
+// are dropped, the name is normalized to NFC, control and reserved characters
+// are removed or replaced, leading dots are stripped so the file is not
+// hidden, Windows device names are escaped and the result is capped at
+// MaxFileNameLength bytes while keeping the extension.
+func (t *Tools) SanitizeFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = norm.NFC.String(strings.ToValidUTF8(name, ""))
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(name, ". ")
+	name = strings.TrimRight(name, ". ")
+
+	if name == "" {
+		name = "file"
+	}
+
+	stem, _, _ := strings.Cut(name, ".")
+	if windowsReservedNames[strings.ToUpper(strings.TrimSpace(stem))] {
+		name = "_" + name
+	}
+
+	ext := filepath.Ext(name)
+	return truncateFileName(strings.TrimSuffix(name, ext), "", ext, t.maxFileNameLength())
+}
+
+func (t *Tools) maxFileNameLength() int {
+	if t.MaxFileNameLength > 0 {
+		return t.MaxFileNameLength
+	}
+	return defaultMaxFileNameLength
+}
+
+// truncateFileName joins base, suffix and ext, cutting base on a rune
+// boundary so the result fits in max bytes. Overlong extensions are cut too.
+// A suffix is always kept, so with a very small max the result holds the
+// suffix alone and may be longer than max.
+func truncateFileName(base, suffix, ext string, max int) string {
+	if len(ext) > max/2 || len(suffix)+len(ext) > max {
+		ext = ""
+	}
+
+	room := max - len(suffix) - len(ext)
+	if room < 0 {
+		room = 0
+	}
+	if len(base) > room {
+		cut := room
+		for cut > 0 && !utf8.RuneStart(base[cut]) {
+			cut--
+		}
+		base = strings.TrimRight(base[:cut], ". ")
+	}
+
+	return base + suffix + ext
+}
+
+// resolveCollision applies policy to name within uploadDir and returns the
+// name the upload should be stored under. Names in reserved, kept in lower
+// case, were just taken by files of the same upload; they always get a
+// suffix, whatever the policy, so one entry cannot replace another.
+func (t *Tools) resolveCollision(ctx context.Context, uploadDir, name string,
+	policy CollisionPolicy, reserved map[string]bool) (string, error) {
+	exists := func(name string) (bool, error) {
+		if reserved[strings.ToLower(name)] {
+			return true, nil
+		}
+		if policy == CollisionOverwrite {
+			return false, nil
+		}
+		_, err := t.statStored(ctx, storageKey(uploadDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	taken, err := exists(name)
+	if err != nil || !taken {
+		return name, err
+	}
+
+	if policy == CollisionError && !reserved[strings.ToLower(name)] {
+		return "", ErrFileExists
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 1; ; i++ {
+		candidate := truncateFileName(base, fmt.Sprintf(" (%d)", i), ext, t.maxFileNameLength())
+
+		taken, err := exists(candidate)
+		if err != nil || !taken {
+			return candidate, err
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package toolkit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTools_SanitizeFileName(t *testing.T) {
+	var sanitizeTests = []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "plain", input: "report.pdf", expected: "report.pdf"},
+		{name: "unix path", input: "../../etc/passwd", expected: "passwd"},
+		{name: "windows path", input: `C:\Users\me\photo.jpg`, expected: "photo.jpg"},
+		{name: "reserved characters", input: `what?<is>"this"|*.txt`, expected: "what__is__this___.txt"},
+		{name: "control characters", input: "bad\x00na\x1fme\u200b.txt", expected: "badname.txt"},
+		{name: "hidden file", input: ".htaccess", expected: "htaccess"},
+		{name: "trailing dots and spaces", input: "name.txt. . ", expected: "name.txt"},
+		{name: "only dots", input: "..", expected: "file"},
+		{name: "empty", input: "", expected: "file"},
+		{name: "reserved device name", input: "con.txt", expected: "_con.txt"},
+		{name: "reserved device name upper case", input: "LPT1", expected: "_LPT1"},
+		{name: "not a device name", input: "console.txt", expected: "console.txt"},
+		{name: "normalization", input: "cafe\u0301.txt", expected: "caf\u00e9.txt"},
+	}
+
+	var testTools Tools
+
+	for _, e := range sanitizeTests {
+		if got := testTools.SanitizeFileName(e.input); got != e.expected {
+			t.Errorf("%s: expected %q, got %q", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestTools_SanitizeFileNameLength(t *testing.T) {
+	testTools := Tools{MaxFileNameLength: 20}
+
+	name := testTools.SanitizeFileName(strings.Repeat("é", 30) + ".jpeg")
+	if len(name) > 20 || !strings.HasSuffix(name, ".jpeg") {
+		t.Errorf("expected name capped at 20 bytes keeping the extension, got %q", name)
+	}
+	if name != "ééééééé.jpeg" {
+		t.Errorf("name was not cut on a rune boundary: %q", name)
+	}
+
+	testTools = Tools{}
+	if name := testTools.SanitizeFileName(strings.Repeat("a", 300) + ".txt"); len(name) != 255 {
+		t.Errorf("expected default cap of 255 bytes, got %d", len(name))
+	}
+}
+
+func TestTools_UploadCollisionPolicy(t *testing.T) {
+	var collisionTests = []struct {
+		name          string
+		policy        CollisionPolicy
+		maxLength     int
+		expectedNames []string
+		expectedErr   error
+	}{
+		{name: "overwrite", policy: CollisionOverwrite,
+			expectedNames: []string{"notes.txt", "notes.txt", "notes.txt"}},
+		{name: "suffix", policy: CollisionSuffix,
+			expectedNames: []string{"notes.txt", "notes (1).txt", "notes (2).txt"}},
+		{name: "suffix tiny limit", policy: CollisionSuffix, maxLength: 3,
+			expectedNames: []string{"not", " (1)", " (2)"}},
+		{name: "suffix short limit", policy: CollisionSuffix, maxLength: 7,
+			expectedNames: []string{"notes", "not (1)", "not (2)"}},
+		{name: "error", policy: CollisionError,
+			expectedNames: []string{"notes.txt"}, expectedErr: ErrFileExists},
+	}
+
+	for _, e := range collisionTests {
+		uploadDir := t.TempDir()
+		testTools := Tools{OnCollision: e.policy, MaxFileNameLength: e.maxLength}
+
+		var names []string
+		var err error
+		for i := 0; i < 3; i++ {
+			var uploadedFile *UploadedFile
+			uploadedFile, err = testTools.UploadOneFile(
+				newUploadRequest(t, testFormFile{"file", "../notes.txt", []byte{byte('a' + i)}}),
+				uploadDir, false)
+			if err != nil {
+				break
+			}
+			names = append(names, uploadedFile.NewFileName)
+		}
+
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+		if strings.Join(names, ",") != strings.Join(e.expectedNames, ",") {
+			t.Errorf("%s: expected names %v, got %v", e.name, e.expectedNames, names)
+		}
+
+		content, _ := os.ReadFile(filepath.Join(uploadDir, e.expectedNames[0]))
+		expected := "a"
+		if e.policy == CollisionOverwrite {
+			expected = "c"
+		}
+		if string(content) != expected {
+			t.Errorf("%s: expected stored content %q, got %q", e.name, expected, content)
+		}
+	}
+}
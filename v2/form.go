@@ -0,0 +1,160 @@
+package toolkit
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidFormValue = errors.New("the form value is invalid")
+
+// UploadResult holds everything a multipart form carried. Files are in the
+// order they were saved: the order of submission when streaming, and grouped
+// by field name otherwise. Files extracted from an archive take the place of
+// the archive.
+type UploadResult struct {
+	Files  []*UploadedFile
+	Fields map[string][]*UploadedFile
+	Values url.Values
+}
+
+func newUploadResult(batch *uploadBatch) *UploadResult {
+	result := &UploadResult{
+		Files:  batch.files,
+		Fields: make(map[string][]*UploadedFile),
+		Values: url.Values(batch.values),
+	}
+	if result.Values == nil {
+		result.Values = make(url.Values)
+	}
+
+	for _, f := range batch.files {
+		result.Fields[f.field] = append(result.Fields[f.field], f)
+	}
+	return result
+}
+
+// File returns the first file uploaded in field, or nil.
+func (r *UploadResult) File(field string) *UploadedFile {
+	if files := r.Fields[field]; len(files) > 0 {
+		return files[0]
+	}
+	return nil
+}
+
+// Decode stores the text fields in the struct that v points to. Struct fields
+// are matched by their form tag, or by name when they have none, and a tag of
+// "-" skips a field. Slices receive every value of a form field, other types
+// the first one. Strings, bools, numbers, pointers to them and types that
+// implement encoding.TextUnmarshaler are supported. Struct fields without a
+// form value are left unchanged.
+func (r *UploadResult) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("toolkit: Decode needs a non-nil pointer to a struct, got %T", v)
+	}
+	return decodeForm(r.Values, rv.Elem())
+}
+
+func decodeForm(values url.Values, rv reflect.Value) error {
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		tag, hasTag := sf.Tag.Lookup("form")
+		name, _, _ := strings.Cut(tag, ",")
+
+		if sf.Anonymous && !hasTag && sf.Type.Kind() == reflect.Struct {
+			if err := decodeForm(values, rv.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !sf.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+
+		vs, ok := values[name]
+		if !ok || len(vs) == 0 {
+			continue
+		}
+
+		fv := rv.Field(i)
+		var err error
+		if fv.Kind() == reflect.Slice && !isTextUnmarshaler(fv) {
+			slice := reflect.MakeSlice(fv.Type(), len(vs), len(vs))
+			for j, s := range vs {
+				if err = setFormValue(slice.Index(j), s); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				fv.Set(slice)
+			}
+		} else {
+			err = setFormValue(fv, vs[0])
+		}
+		if err != nil {
+			return &UploadError{Err: fmt.Errorf("%w: %v", ErrInvalidFormValue, err), Field: name}
+		}
+	}
+
+	return nil
+}
+
+func isTextUnmarshaler(v reflect.Value) bool {
+	_, ok := v.Addr().Interface().(encoding.TextUnmarshaler)
+	return ok
+}
+
+func setFormValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
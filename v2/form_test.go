@@ -0,0 +1,127 @@
+package toolkit
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTools_UploadForm(t *testing.T) {
+	text := []byte("some text")
+
+	for _, stream := range []bool{false, true} {
+		testTools := Tools{StreamUploads: stream}
+
+		request := newUploadRequestWithValues(t, url.Values{"caption": {"holiday"}},
+			testFormFile{"photos", "a.txt", text},
+			testFormFile{"cover", "b.txt", text},
+			testFormFile{"photos", "c.txt", text})
+
+		result, err := testTools.UploadForm(request, t.TempDir(), false)
+		if err != nil {
+			t.Fatalf("stream %v: %v", stream, err)
+		}
+
+		var names []string
+		for _, f := range result.Files {
+			names = append(names, f.OriginalFileName)
+		}
+		expected := []string{"b.txt", "a.txt", "c.txt"}
+		if stream {
+			expected = []string{"a.txt", "b.txt", "c.txt"}
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("stream %v: expected files %v, got %v", stream, expected, names)
+		}
+
+		photos := result.Fields["photos"]
+		if len(photos) != 2 || photos[0].OriginalFileName != "a.txt" ||
+			photos[1].OriginalFileName != "c.txt" {
+			t.Errorf("stream %v: wrong photos %v", stream, photos)
+		}
+		if f := result.File("cover"); f == nil || f.OriginalFileName != "b.txt" {
+			t.Errorf("stream %v: wrong cover %v", stream, f)
+		}
+		if result.File("missing") != nil {
+			t.Errorf("stream %v: expected no file for a missing field", stream)
+		}
+
+		if caption := result.Values.Get("caption"); caption != "holiday" {
+			t.Errorf("stream %v: expected caption holiday, got %q", stream, caption)
+		}
+	}
+}
+
+type testFormMeta struct {
+	Source string `form:"source"`
+}
+
+type testForm struct {
+	testFormMeta
+	Caption  string    `form:"caption"`
+	AlbumID  int64     `form:"album_id"`
+	Public   *bool     `form:"public"`
+	Rating   float64   `form:"rating"`
+	Tags     []string  `form:"tag"`
+	Sizes    []uint    `form:"size"`
+	TakenAt  time.Time `form:"taken_at"`
+	Untagged string
+	Skipped  string `form:"-"`
+}
+
+func TestUploadResult_Decode(t *testing.T) {
+	var decodeTests = []struct {
+		name        string
+		values      url.Values
+		expected    testForm
+		expectedErr error
+	}{
+		{name: "all fields", values: url.Values{
+			"source":   {"phone"},
+			"caption":  {"holiday", "ignored"},
+			"album_id": {"42"},
+			"public":   {"true"},
+			"rating":   {"4.5"},
+			"tag":      {"beach", "sun"},
+			"size":     {"1", "2"},
+			"taken_at": {"2023-06-01T12:00:00Z"},
+			"Untagged": {"yes"},
+			"-":        {"no"},
+		}, expected: testForm{
+			testFormMeta: testFormMeta{Source: "phone"},
+			Caption:      "holiday",
+			AlbumID:      42,
+			Public:       new(bool),
+			Rating:       4.5,
+			Tags:         []string{"beach", "sun"},
+			Sizes:        []uint{1, 2},
+			TakenAt:      time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC),
+			Untagged:     "yes",
+		}},
+		{name: "no values", values: url.Values{}},
+		{name: "bad int", values: url.Values{"album_id": {"abc"}}, expectedErr: ErrInvalidFormValue},
+		{name: "bad slice", values: url.Values{"size": {"1", "-2"}}, expectedErr: ErrInvalidFormValue},
+		{name: "bad time", values: url.Values{"taken_at": {"yesterday"}}, expectedErr: ErrInvalidFormValue},
+	}
+	*decodeTests[0].expected.Public = true
+
+	for _, e := range decodeTests {
+		result := &UploadResult{Values: e.values}
+
+		var form testForm
+		err := result.Decode(&form)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(form, e.expected) {
+			t.Errorf("%s: expected %+v, got %+v", e.name, e.expected, form)
+		}
+	}
+
+	var notStruct string
+	if err := (&UploadResult{}).Decode(&notStruct); err == nil {
+		t.Error("expected an error when decoding into a non-struct")
+	}
+}
@@ -0,0 +1,188 @@
+package toolkit
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	HashMD5     = "md5"
+	HashSHA256  = "sha256"
+	HashSHA512  = "sha512"
+	HashBLAKE2b = "blake2b"
+)
+
+var contentDigestAlgorithms = map[string]string{
+	"md5":     HashMD5,
+	"sha-256": HashSHA256,
+	"sha-512": HashSHA512,
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashMD5:
+		return md5.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	case HashBLAKE2b:
+		return blake2b.New512(nil)
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+}
+
+type digester struct {
+	hashes   map[string]hash.Hash
+	expected map[string][]byte
+}
+
+func (t *Tools) newDigester(header textproto.MIMEHeader) (*digester, error) {
+	d := &digester{
+		hashes:   make(map[string]hash.Hash),
+		expected: make(map[string][]byte),
+	}
+
+	algorithms := t.HashAlgorithms
+	if t.ContentAddressed {
+		algorithms = append([]string{HashSHA256}, algorithms...)
+	}
+
+	if t.VerifyDigests && header != nil {
+		expected, err := parseDigestHeaders(header)
+		if err != nil {
+			return nil, err
+		}
+		d.expected = expected
+		for algorithm := range expected {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+
+	for _, algorithm := range algorithms {
+		if _, ok := d.hashes[algorithm]; ok {
+			continue
+		}
+		h, err := newHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		d.hashes[algorithm] = h
+	}
+
+	return d, nil
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// reset starts the digests over for content that replaces what was read.
+// The digests the client sent only apply to what it uploaded.
+func (d *digester) reset() {
+	for _, h := range d.hashes {
+		h.Reset()
+	}
+	d.expected = nil
+}
+
+func (d *digester) verify() error {
+	for algorithm, expected := range d.expected {
+		if !bytes.Equal(d.hashes[algorithm].Sum(nil), expected) {
+			return ErrDigestMismatch
+		}
+	}
+	return nil
+}
+
+func (d *digester) sum(algorithm string) string {
+	h, ok := d.hashes[algorithm]
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (d *digester) sums() map[string]string {
+	if len(d.hashes) == 0 {
+		return nil
+	}
+
+	sums := make(map[string]string, len(d.hashes))
+	for algorithm := range d.hashes {
+		sums[algorithm] = d.sum(algorithm)
+	}
+	return sums
+}
+
+// reader feeds everything read from r into the digests and turns the final
+// io.EOF into a verification error, so a storage backend never commits a file
+// that does not match the digest the client sent.
+func (d *digester) reader(r io.Reader) io.Reader {
+	return &digestReader{r: io.TeeReader(r, d), d: d}
+}
+
+type digestReader struct {
+	r io.Reader
+	d *digester
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	if err == io.EOF {
+		if verifyErr := dr.d.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+func parseDigestHeaders(header textproto.MIMEHeader) (map[string][]byte, error) {
+	expected := make(map[string][]byte)
+
+	if v := header.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, errors.New("invalid Content-MD5 header")
+		}
+		expected[HashMD5] = sum
+	}
+
+	if v := header.Get("Content-Digest"); v != "" {
+		for _, member := range strings.Split(v, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return nil, errors.New("invalid Content-Digest header")
+			}
+
+			algorithm, supported := contentDigestAlgorithms[strings.ToLower(key)]
+			if !supported {
+				continue
+			}
+
+			sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+			if err != nil {
+				return nil, errors.New("invalid Content-Digest header")
+			}
+			expected[algorithm] = sum
+		}
+	}
+
+	return expected, nil
+}
@@ -0,0 +1,198 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+)
+
+func newDigestUploadRequest(t *testing.T, content []byte, header map[string]string) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="file"; filename="notes.txt"`)
+	h.Set("Content-Type", "text/plain")
+	for k, v := range header {
+		h.Set(k, v)
+	}
+
+	part, err := writer.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	writer.Close()
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func TestTools_UploadHashes(t *testing.T) {
+	content := []byte("hello world")
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+
+	testTools := Tools{HashAlgorithms: []string{HashSHA256, HashMD5, HashBLAKE2b}}
+
+	uploadedFile, err := testTools.UploadOneFile(newDigestUploadRequest(t, content, nil), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFile.Hashes[HashSHA256] != hex.EncodeToString(sha[:]) {
+		t.Errorf("wrong sha256 digest %s", uploadedFile.Hashes[HashSHA256])
+	}
+	if uploadedFile.Hashes[HashMD5] != hex.EncodeToString(md[:]) {
+		t.Errorf("wrong md5 digest %s", uploadedFile.Hashes[HashMD5])
+	}
+	if len(uploadedFile.Hashes[HashBLAKE2b]) != 128 {
+		t.Errorf("wrong blake2b digest %s", uploadedFile.Hashes[HashBLAKE2b])
+	}
+
+	testTools.HashAlgorithms = []string{"crc32"}
+	if _, err := testTools.UploadOneFile(newDigestUploadRequest(t, content, nil), t.TempDir()); err == nil {
+		t.Error("expected error for unsupported hash algorithm")
+	}
+}
+
+func TestTools_UploadVerifyDigests(t *testing.T) {
+	content := []byte("hello world")
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+	wrong := sha256.Sum256([]byte("something else"))
+
+	var digestTests = []struct {
+		name        string
+		stream      bool
+		header      map[string]string
+		expectedErr error
+	}{
+		{name: "valid content digest",
+			header: map[string]string{"Content-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(sha[:]) + ":"}},
+		{name: "valid content md5", stream: true,
+			header: map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md[:])}},
+		{name: "mismatched content digest",
+			header:      map[string]string{"Content-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(wrong[:]) + ":"},
+			expectedErr: ErrDigestMismatch},
+		{name: "mismatched digest streaming", stream: true,
+			header:      map[string]string{"Content-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(wrong[:]) + ":"},
+			expectedErr: ErrDigestMismatch},
+	}
+
+	for _, e := range digestTests {
+		uploadDir := t.TempDir()
+		testTools := Tools{VerifyDigests: true, StreamUploads: e.stream}
+
+		_, err := testTools.UploadOneFile(newDigestUploadRequest(t, content, e.header), uploadDir)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+
+		entries, _ := os.ReadDir(uploadDir)
+		if e.expectedErr != nil && len(entries) != 0 {
+			t.Errorf("%s: expected no file to be stored", e.name)
+		}
+	}
+}
+
+func TestTools_UploadContentAddressed(t *testing.T) {
+	img := readTestImage(t)
+	sha := sha256.Sum256(img)
+	uploadDir := t.TempDir()
+
+	testTools := Tools{ContentAddressed: true}
+
+	first, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "image.jpg", img}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "copy.jpg", img}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.NewFileName != hex.EncodeToString(sha[:])+".jpg" {
+		t.Errorf("unexpected content addressed name %s", first.NewFileName)
+	}
+	if first.NewFileName != second.NewFileName {
+		t.Error("expected identical files to share a name")
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 1 {
+		t.Errorf("expected a single stored file, found %d", len(entries))
+	}
+}
+
+func TestTools_UploadContentAddressedExpiry(t *testing.T) {
+	img := readTestImage(t)
+
+	var expiryTests = []struct {
+		name     string
+		ttls     []time.Duration
+		expected time.Duration
+	}{
+		{name: "permanent then expiring", ttls: []time.Duration{0, time.Nanosecond}},
+		{name: "expiring then permanent", ttls: []time.Duration{time.Hour, 0}},
+		{name: "latest expiry wins", ttls: []time.Duration{2 * time.Hour, time.Hour}, expected: 2 * time.Hour},
+		{name: "later expiry extends", ttls: []time.Duration{time.Hour, 2 * time.Hour}, expected: 2 * time.Hour},
+	}
+
+	for _, e := range expiryTests {
+		uploadDir := t.TempDir()
+
+		var uploadedFile *UploadedFile
+		for _, ttl := range e.ttls {
+			testTools := Tools{ContentAddressed: true, UploadTTL: ttl}
+			var err error
+			uploadedFile, err = testTools.UploadOneFile(
+				newUploadRequest(t, testFormFile{"file", "image.jpg", img}), uploadDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !uploadedFile.Deduplicated {
+			t.Errorf("%s: expected the second upload to be deduplicated", e.name)
+		}
+
+		var testTools Tools
+		record, err := testTools.NewManifest(uploadDir).Lookup(context.Background(), uploadedFile.NewFileName)
+		if errors.Is(err, fs.ErrNotExist) && e.expected == 0 {
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+		if e.expected == 0 {
+			if !record.ExpiresAt.IsZero() {
+				t.Errorf("%s: expected no expiry, got %v", e.name, record.ExpiresAt)
+			}
+			continue
+		}
+		expected := time.Now().Add(e.expected)
+		if d := record.ExpiresAt.Sub(expected); d < -time.Minute || d > time.Minute {
+			t.Errorf("%s: expected expiry near %v, got %v", e.name, expected, record.ExpiresAt)
+		}
+	}
+}
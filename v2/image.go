@@ -0,0 +1,505 @@
+package toolkit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	defaultMaxImageDimension = 10000
+	defaultMaxImagePixels    = 25_000_000
+	imageHeaderLen           = 256 << 10
+)
+
+type ImageVariant struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}
+
+// ImageOptions controls how uploaded images are checked and processed.
+// MaxPixels caps the number of pixels an image may decode to, counting every
+// frame of an animated GIF, and defaults to 25 million, which keeps each
+// decoded copy of an image around 100MB.
+type ImageOptions struct {
+	MaxWidth      int
+	MaxHeight     int
+	MaxPixels     int64
+	StripMetadata bool
+	AutoOrient    bool
+	JPEGQuality   int
+	Variants      []ImageVariant
+}
+
+type ImageVariantFile struct {
+	Name     string
+	FileName string
+	Width    int
+	Height   int
+}
+
+func (t *Tools) processesImage(fileType string) bool {
+	if t.ImageProcessing == nil {
+		return false
+	}
+
+	switch fileType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// processImage validates the staged image at key, rewrites it when metadata
+// has to go or the orientation has to be fixed, and returns the decoded image
+// when variants still need to be generated from it. A rewritten image is
+// hashed again into digests.
+func (t *Tools) processImage(ctx context.Context, key, fileType string,
+	uploadedFile *UploadedFile, part *uploadPart, digests *digester) (image.Image, error) {
+	opts := t.ImageProcessing
+	s := t.storage()
+
+	content, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	head, err := io.ReadAll(io.LimitReader(content, imageHeaderLen))
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), content))
+	content.Close()
+	if err != nil {
+		return nil, part.error(ErrInvalidImage)
+	}
+
+	maxWidth, maxHeight := opts.MaxWidth, opts.MaxHeight
+	if maxWidth <= 0 && maxHeight <= 0 {
+		maxWidth, maxHeight = defaultMaxImageDimension, defaultMaxImageDimension
+	}
+	maxPixels := opts.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = defaultMaxImagePixels
+	}
+	tooLarge := func() error {
+		uploadErr := part.error(ErrImageTooLarge)
+		uploadErr.FileType = fileType
+		return uploadErr
+	}
+	if (maxWidth > 0 && config.Width > maxWidth) || (maxHeight > 0 && config.Height > maxHeight) ||
+		int64(config.Width)*int64(config.Height) > maxPixels {
+		return nil, tooLarge()
+	}
+
+	orientation := 1
+	if opts.AutoOrient && fileType == "image/jpeg" {
+		orientation = jpegOrientation(head)
+	}
+
+	rewrite := opts.StripMetadata || orientation != 1
+	if !rewrite && len(opts.Variants) == 0 {
+		uploadedFile.Width, uploadedFile.Height = config.Width, config.Height
+		return nil, nil
+	}
+
+	// Every frame of a GIF is decoded, so the frames are added up first
+	// without decoding them.
+	if fileType == "image/gif" {
+		content, err = s.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		pixels, err := gifPixels(content, maxPixels)
+		content.Close()
+		if err != nil {
+			return nil, part.error(ErrInvalidImage)
+		}
+		if pixels > maxPixels {
+			return nil, tooLarge()
+		}
+	}
+
+	content, err = s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	var img image.Image
+	var animation *gif.GIF
+
+	if fileType == "image/gif" {
+		animation, err = gif.DecodeAll(content)
+		if err == nil {
+			img = animation.Image[0]
+		}
+	} else {
+		img, _, err = image.Decode(content)
+	}
+	if err != nil {
+		return nil, part.error(ErrInvalidImage)
+	}
+
+	img = orientImage(img, orientation)
+	bounds := img.Bounds()
+	uploadedFile.Width, uploadedFile.Height = bounds.Dx(), bounds.Dy()
+
+	if rewrite {
+		var buf bytes.Buffer
+		if animation != nil {
+			err = gif.EncodeAll(&buf, animation)
+		} else {
+			err = t.encodeImage(&buf, img, fileType)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		digests.reset()
+		n, err := s.Put(ctx, key, io.TeeReader(&buf, digests))
+		if err != nil {
+			return nil, err
+		}
+		uploadedFile.FileSize = n
+		uploadedFile.Hashes = digests.sums()
+	}
+
+	return img, nil
+}
+
+// gifPixels adds up the areas of the frames of a GIF by walking its blocks,
+// without decompressing any of them. It stops once the total passes limit.
+func gifPixels(r io.Reader, limit int64) (int64, error) {
+	br := bufio.NewReader(r)
+
+	var header [13]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "GIF" {
+		return 0, image.ErrFormat
+	}
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << (header[10]&0x07 + 1)); err != nil {
+			return 0, err
+		}
+	}
+
+	var total int64
+	for total <= limit {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch b {
+		case 0x21:
+			// extension label
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x2C:
+			var desc [9]byte
+			if _, err := io.ReadFull(br, desc[:]); err != nil {
+				return 0, err
+			}
+			total += int64(binary.LittleEndian.Uint16(desc[4:])) * int64(binary.LittleEndian.Uint16(desc[6:]))
+			if desc[8]&0x80 != 0 {
+				if _, err := br.Discard(3 << (desc[8]&0x07 + 1)); err != nil {
+					return 0, err
+				}
+			}
+			// LZW minimum code size
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x3B:
+			return total, nil
+		default:
+			return 0, image.ErrFormat
+		}
+
+		if err := skipGIFSubBlocks(br); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func skipGIFSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil || size == 0 {
+			return err
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// saveImageVariants stores the variants next to the upload and charges them
+// to the quota. The client never named them, so a variant that would replace
+// an existing file gets a numbered suffix whatever the collision policy.
+func (t *Tools) saveImageVariants(ctx context.Context, uploadDir, fileType string,
+	img image.Image, uploadedFile *UploadedFile, part *uploadPart) error {
+	ext := path.Ext(uploadedFile.NewFileName)
+	base := strings.TrimSuffix(uploadedFile.NewFileName, ext)
+
+	for _, v := range t.ImageProcessing.Variants {
+		resized := resizeImage(img, v.MaxWidth, v.MaxHeight)
+
+		var buf bytes.Buffer
+		if err := t.encodeImage(&buf, resized, fileType); err != nil {
+			return err
+		}
+
+		name, err := t.resolveCollision(ctx, uploadDir, base+"_"+v.Name+ext, CollisionSuffix,
+			part.reserved)
+		if err != nil {
+			return err
+		}
+
+		variant := &ImageVariantFile{
+			Name:     v.Name,
+			FileName: name,
+			Width:    resized.Bounds().Dx(),
+			Height:   resized.Bounds().Dy(),
+		}
+
+		var src io.Reader = &buf
+		if part.quota != nil {
+			if err := part.quota.addFile(); err != nil {
+				return err
+			}
+			src = part.quota.reader(src)
+		}
+
+		if _, err := t.storage().Put(ctx, storageKey(uploadDir, variant.FileName), src); err != nil {
+			return err
+		}
+
+		uploadedFile.Variants = append(uploadedFile.Variants, variant)
+	}
+	return nil
+}
+
+func (t *Tools) encodeImage(w io.Writer, img image.Image, fileType string) error {
+	switch fileType {
+	case "image/png":
+		return png.Encode(w, img)
+	case "image/gif":
+		return gif.Encode(w, img, nil)
+	default:
+		quality := t.ImageProcessing.JPEGQuality
+		if quality <= 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+}
+
+func fitImageSize(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		if s := float64(maxHeight) / float64(height); s < scale {
+			scale = s
+		}
+	}
+
+	w := int(float64(width)*scale + 0.5)
+	h := int(float64(height)*scale + 0.5)
+	return max(w, 1), max(h, 1)
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
+
+// resizeImage downscales img to fit within maxWidth x maxHeight by averaging
+// the source pixels covered by each destination pixel. Images are never
+// enlarged.
+func resizeImage(img image.Image, maxWidth, maxHeight int) image.Image {
+	src := toRGBA(img)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	dw, dh := fitImageSize(sw, sh, maxWidth, maxHeight)
+	if dw == sw && dh == sh {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[i])
+					g += uint64(src.Pix[i+1])
+					b += uint64(src.Pix[i+2])
+					a += uint64(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4],
+				src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation stored in the APP1 segment of
+// a JPEG file, or 1 when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+
+		marker := data[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+
+		if marker == 0xE1 {
+			if orientation := exifOrientation(data[i+4 : i+2+size]); orientation > 0 {
+				return orientation
+			}
+		}
+
+		i += 2 + size
+	}
+
+	return 1
+}
+
+func exifOrientation(segment []byte) int {
+	if len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := segment[6:]
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 0
+		}
+	}
+
+	return 0
+}
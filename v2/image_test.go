@@ -0,0 +1,319 @@
+package toolkit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withExifOrientation inserts an EXIF APP1 segment carrying the given
+// orientation right after the JPEG start of image marker.
+func withExifOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	var out []byte
+	out = append(out, data[:2]...)
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestTools_UploadImageVariants(t *testing.T) {
+	img := readTestImage(t)
+	uploadDir := t.TempDir()
+
+	testTools := Tools{
+		ImageProcessing: &ImageOptions{
+			Variants: []ImageVariant{
+				{Name: "thumb", MaxWidth: 100, MaxHeight: 100},
+				{Name: "wide", MaxWidth: 550},
+			},
+		},
+	}
+
+	uploadedFile, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "image.jpg", img}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFile.Width != 1100 || uploadedFile.Height != 720 {
+		t.Errorf("wrong original dimensions %dx%d", uploadedFile.Width, uploadedFile.Height)
+	}
+
+	if len(uploadedFile.Variants) != 2 {
+		t.Fatalf("expected 2 variants, got %d", len(uploadedFile.Variants))
+	}
+
+	expected := []struct{ width, height int }{{100, 65}, {550, 360}}
+	for i, v := range uploadedFile.Variants {
+		if v.Width != expected[i].width || v.Height != expected[i].height {
+			t.Errorf("variant %s: wrong dimensions %dx%d", v.Name, v.Width, v.Height)
+		}
+
+		f, err := os.Open(filepath.Join(uploadDir, v.FileName))
+		if err != nil {
+			t.Errorf("variant %s: %v", v.Name, err)
+			continue
+		}
+		config, err := jpeg.DecodeConfig(f)
+		f.Close()
+		if err != nil || config.Width != v.Width || config.Height != v.Height {
+			t.Errorf("variant %s: stored image does not match reported size", v.Name)
+		}
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 3 {
+		t.Errorf("expected original and 2 variants on disk, found %d files", len(entries))
+	}
+}
+
+// newTestGIF encodes an animation of frames frames of width x height. With a
+// global palette the frames share it, otherwise each has a local one.
+func newTestGIF(t *testing.T, frames, width, height int, global bool) []byte {
+	t.Helper()
+
+	animation := &gif.GIF{}
+	if global {
+		animation.Config = image.Config{ColorModel: color.Palette(palette.Plan9),
+			Width: width, Height: height}
+	}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9[:2+i%2])
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFPixels(t *testing.T) {
+	var gifTests = []struct {
+		name     string
+		content  []byte
+		limit    int64
+		expected int64
+	}{
+		{name: "local palettes", content: newTestGIF(t, 5, 30, 20, false), limit: 1 << 20, expected: 3000},
+		{name: "global palette", content: newTestGIF(t, 4, 10, 10, true), limit: 1 << 20, expected: 400},
+		{name: "stops at limit", content: newTestGIF(t, 5, 10, 10, false), limit: 150, expected: 200},
+	}
+
+	for _, e := range gifTests {
+		pixels, err := gifPixels(bytes.NewReader(e.content), e.limit)
+		if err != nil || pixels != e.expected {
+			t.Errorf("%s: expected %d pixels, got %d (%v)", e.name, e.expected, pixels, err)
+		}
+	}
+
+	if _, err := gifPixels(bytes.NewReader([]byte("GIF89a")), 100); err == nil {
+		t.Error("expected an error for a truncated GIF")
+	}
+}
+
+func TestTools_UploadImageChecks(t *testing.T) {
+	img := readTestImage(t)
+	broken := append([]byte{0xFF, 0xD8, 0xFF, 0xDB}, bytes.Repeat([]byte{0x01}, 64)...)
+
+	var imageTests = []struct {
+		name        string
+		content     []byte
+		opts        ImageOptions
+		expectedErr error
+	}{
+		{name: "too wide", content: img,
+			opts:        ImageOptions{MaxWidth: 1000},
+			expectedErr: ErrImageTooLarge},
+		{name: "too tall", content: img,
+			opts:        ImageOptions{MaxHeight: 700},
+			expectedErr: ErrImageTooLarge},
+		{name: "within limits", content: img,
+			opts: ImageOptions{MaxWidth: 1100, MaxHeight: 720}},
+		{name: "too many pixels", content: img,
+			opts:        ImageOptions{MaxPixels: 700_000},
+			expectedErr: ErrImageTooLarge},
+		{name: "too many frames", content: newTestGIF(t, 30, 1000, 1000, false),
+			opts:        ImageOptions{StripMetadata: true},
+			expectedErr: ErrImageTooLarge},
+		{name: "frames within budget", content: newTestGIF(t, 3, 100, 100, false),
+			opts: ImageOptions{StripMetadata: true, MaxPixels: 30_000}},
+		{name: "undecodable image", content: broken,
+			expectedErr: ErrInvalidImage},
+	}
+
+	for _, e := range imageTests {
+		uploadDir := t.TempDir()
+		opts := e.opts
+		testTools := Tools{ImageProcessing: &opts}
+
+		_, err := testTools.UploadOneFile(
+			newUploadRequest(t, testFormFile{"file", "image.jpg", e.content}), uploadDir)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+
+		entries, _ := os.ReadDir(uploadDir)
+		if e.expectedErr != nil && len(entries) != 0 {
+			t.Errorf("%s: expected rejected image to be removed", e.name)
+		}
+	}
+}
+
+func TestTools_UploadImageAutoOrient(t *testing.T) {
+	img := withExifOrientation(readTestImage(t), 6)
+	uploadDir := t.TempDir()
+
+	testTools := Tools{
+		ImageProcessing:  &ImageOptions{AutoOrient: true, StripMetadata: true},
+		ContentAddressed: true,
+	}
+
+	uploadedFile, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "image.jpg", img}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFile.Width != 720 || uploadedFile.Height != 1100 {
+		t.Errorf("expected rotated dimensions, got %dx%d", uploadedFile.Width, uploadedFile.Height)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(uploadDir, uploadedFile.NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stored, []byte("Exif")) || bytes.Contains(stored, []byte("Photoshop")) {
+		t.Error("expected metadata to be stripped")
+	}
+	if uploadedFile.FileSize != int64(len(stored)) {
+		t.Errorf("reported size %d does not match stored size %d", uploadedFile.FileSize, len(stored))
+	}
+	sha := sha256.Sum256(stored)
+	if uploadedFile.Hashes[HashSHA256] != hex.EncodeToString(sha[:]) {
+		t.Error("reported digest does not match the stored image")
+	}
+	if uploadedFile.NewFileName != hex.EncodeToString(sha[:])+".jpg" {
+		t.Errorf("expected the name to follow the stored image, got %s", uploadedFile.NewFileName)
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stored))
+	if err != nil || config.Width != 720 || config.Height != 1100 {
+		t.Errorf("stored image was not rotated: %v", err)
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := readTestImage(t)
+
+	if o := jpegOrientation(img); o != 1 {
+		t.Errorf("expected orientation 1 without EXIF, got %d", o)
+	}
+
+	for o := uint16(1); o <= 8; o++ {
+		if got := jpegOrientation(withExifOrientation(img, o)); got != int(o) {
+			t.Errorf("expected orientation %d, got %d", o, got)
+		}
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// A 2x1 image with a red pixel on the left and a blue pixel on the right.
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	var orientTests = []struct {
+		orientation int
+		width       int
+		height      int
+		topLeft     color.RGBA
+	}{
+		{1, 2, 1, red},
+		{2, 2, 1, blue},
+		{3, 2, 1, blue},
+		{6, 1, 2, red},
+		{8, 1, 2, blue},
+	}
+
+	for _, e := range orientTests {
+		dst := orientImage(src, e.orientation)
+		b := dst.Bounds()
+		if b.Dx() != e.width || b.Dy() != e.height {
+			t.Errorf("orientation %d: wrong size %dx%d", e.orientation, b.Dx(), b.Dy())
+		}
+		if dst.At(0, 0) != e.topLeft {
+			t.Errorf("orientation %d: wrong top left pixel %v", e.orientation, dst.At(0, 0))
+		}
+	}
+}
+
+func TestTools_UploadImageVariantNames(t *testing.T) {
+	img := readTestImage(t)
+	variants := &ImageOptions{Variants: []ImageVariant{{Name: "thumb", MaxWidth: 100}}}
+
+	var variantTests = []struct {
+		name        string
+		tools       Tools
+		variant     string
+		expectedErr error
+	}{
+		{name: "existing name", tools: Tools{ImageProcessing: variants}, variant: "photo_thumb (1).jpg"},
+		{name: "collision error", tools: Tools{ImageProcessing: variants, OnCollision: CollisionError},
+			variant: "photo_thumb (1).jpg"},
+		{name: "quota", tools: Tools{ImageProcessing: variants, Quota: &QuotaOptions{MaxFiles: 2}},
+			expectedErr: ErrQuotaFiles},
+	}
+
+	for _, e := range variantTests {
+		uploadDir := t.TempDir()
+		existing := filepath.Join(uploadDir, "photo_thumb.jpg")
+		if err := os.WriteFile(existing, []byte("other upload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		uploadedFile, err := e.tools.UploadOneFile(
+			newUploadRequest(t, testFormFile{"file", "photo.jpg", img}), uploadDir, false)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+		if err == nil && uploadedFile.Variants[0].FileName != e.variant {
+			t.Errorf("%s: expected variant %s, got %s", e.name, e.variant, uploadedFile.Variants[0].FileName)
+		}
+
+		if content, _ := os.ReadFile(existing); string(content) != "other upload" {
+			t.Errorf("%s: the existing file was replaced", e.name)
+		}
+		if e.expectedErr != nil {
+			if _, err := os.Stat(filepath.Join(uploadDir, "photo.jpg")); !os.IsNotExist(err) {
+				t.Errorf("%s: expected the upload to be removed, got %v", e.name, err)
+			}
+		}
+	}
+}
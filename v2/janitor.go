@@ -0,0 +1,259 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJanitorInterval = 10 * time.Minute
+	defaultOrphanAge       = 24 * time.Hour
+)
+
+type RemovalReason string
+
+const (
+	RemovalExpired  RemovalReason = "expired"
+	RemovalOrphaned RemovalReason = "orphaned"
+)
+
+type RemovedFile struct {
+	Dir    string
+	Name   string
+	Reason RemovalReason
+}
+
+// JanitorOptions configures a Janitor. Uploads in Dirs are removed once the
+// expiry recorded in their sidecar has passed. Temporary files left behind by
+// interrupted uploads, sidecars without an upload and tus uploads that were
+// abandoned are removed once they are older than OrphanAge, 24 hours by
+// default; expired tus uploads are removed straight away.
+type JanitorOptions struct {
+	Dirs      []string
+	Interval  time.Duration
+	OrphanAge time.Duration
+	OnRemove  func(RemovedFile)
+	OnError   func(error)
+}
+
+type Janitor struct {
+	t    *Tools
+	opts JanitorOptions
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	startOnce sync.Once
+}
+
+// NewJanitor returns a janitor for the upload directories in opts. It does
+// nothing until Start or Sweep is called.
+func (t *Tools) NewJanitor(opts JanitorOptions) *Janitor {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultJanitorInterval
+	}
+	if opts.OrphanAge <= 0 {
+		opts.OrphanAge = defaultOrphanAge
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Janitor{
+		t:      t,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// StartJanitor starts a janitor that sweeps right away and then every
+// Interval until it is stopped.
+func (t *Tools) StartJanitor(opts JanitorOptions) *Janitor {
+	j := t.NewJanitor(opts)
+	j.Start()
+	return j
+}
+
+func (j *Janitor) Start() {
+	j.startOnce.Do(func() { go j.run() })
+}
+
+func (j *Janitor) run() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := j.Sweep(j.ctx)
+		if err != nil && j.ctx.Err() == nil && j.opts.OnError != nil {
+			j.opts.OnError(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-j.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop ends the janitor, waiting for a sweep in progress to return. A janitor
+// cannot be started again once stopped.
+func (j *Janitor) Stop() {
+	j.cancel()
+	j.startOnce.Do(func() { close(j.done) })
+	<-j.done
+}
+
+// Sweep removes what has expired or been orphaned in every directory once.
+func (j *Janitor) Sweep(ctx context.Context) error {
+	var errs []error
+	for _, dir := range j.opts.Dirs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := j.sweepStorage(ctx, dir); err != nil {
+			errs = append(errs, err)
+		}
+		if err := j.sweepTus(dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (j *Janitor) sweepStorage(ctx context.Context, dir string) error {
+	s := j.t.storage()
+	m := j.t.NewManifest(dir)
+	now := time.Now()
+
+	files, err := s.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		names[path.Base(f.Name)] = true
+	}
+
+	var errs []error
+	for _, f := range files {
+		name := path.Base(f.Name)
+		orphaned := now.Sub(f.ModTime) > j.opts.OrphanAge
+
+		switch {
+		case strings.HasPrefix(name, tempFilePrefix):
+			if orphaned {
+				errs = append(errs, j.remove(dir, name, RemovalOrphaned,
+					s.Delete(ctx, storageKey(dir, name))))
+			}
+
+		case strings.HasPrefix(name, sidecarPrefix) && strings.HasSuffix(name, sidecarSuffix):
+			upload := strings.TrimSuffix(strings.TrimPrefix(name, sidecarPrefix), sidecarSuffix)
+
+			if !names[upload] {
+				if orphaned {
+					errs = append(errs, j.remove(dir, name, RemovalOrphaned,
+						s.Delete(ctx, storageKey(dir, name))))
+				}
+				continue
+			}
+
+			record, err := m.Lookup(ctx, upload)
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			if !record.ExpiresAt.IsZero() && now.After(record.ExpiresAt) {
+				errs = append(errs, j.remove(dir, upload, RemovalExpired, m.Delete(ctx, upload)))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sweepTus removes partial tus uploads, which are kept on local disk in the
+// upload directory itself.
+func (j *Janitor) sweepTus(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	h := &TusHandler{uploadDir: dir}
+	now := time.Now()
+
+	var errs []error
+	for _, e := range entries {
+		// Completed uploads leave only their record behind.
+		if id, ok := strings.CutSuffix(e.Name(), ".info"); ok {
+			id, ok = strings.CutPrefix(id, ".")
+			if !ok || len(id) != tusIDLength {
+				continue
+			}
+			upload, err := h.load(id)
+			if err == nil && upload.Completed && !upload.ExpiresAt.IsZero() && now.After(upload.ExpiresAt) {
+				errs = append(errs, j.remove(dir, e.Name(), RemovalExpired, os.Remove(h.infoPath(id))))
+			}
+			continue
+		}
+
+		id, ok := strings.CutSuffix(e.Name(), ".part")
+		if !ok || len(id) != tusIDLength || !tusIDPattern.MatchString(id) {
+			continue
+		}
+
+		stat, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		reason := RemovalReason("")
+		upload, err := h.load(id)
+		switch {
+		case err == nil && !upload.ExpiresAt.IsZero() && now.After(upload.ExpiresAt):
+			reason = RemovalExpired
+		case now.Sub(stat.ModTime()) > j.opts.OrphanAge:
+			reason = RemovalOrphaned
+		}
+		if reason == "" {
+			continue
+		}
+
+		err = os.Remove(h.partPath(id))
+		if infoErr := os.Remove(h.infoPath(id)); err == nil && !os.IsNotExist(infoErr) {
+			err = infoErr
+		}
+		errs = append(errs, j.remove(dir, e.Name(), reason, err))
+	}
+	return errors.Join(errs...)
+}
+
+// remove reports a removal that finished with err. Files that were already
+// gone are not reported at all.
+func (j *Janitor) remove(dir, name string, reason RemovalReason, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if j.opts.OnRemove != nil {
+		j.opts.OnRemove(RemovedFile{Dir: dir, Name: name, Reason: reason})
+	}
+	return nil
+}
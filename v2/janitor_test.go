@@ -0,0 +1,196 @@
+package toolkit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJanitor_Sweep(t *testing.T) {
+	uploadDir := t.TempDir()
+	text := []byte("some text")
+	old := time.Now().Add(-2 * time.Hour)
+
+	testTools := Tools{
+		UploadPolicies: map[string]UploadPolicy{"preview": {TTL: time.Nanosecond}},
+	}
+
+	result, err := testTools.UploadForm(newUploadRequest(t,
+		testFormFile{"preview", "preview.txt", text},
+		testFormFile{"export", "export.txt", text}), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.File("preview").ExpiresAt.IsZero() || !result.File("export").ExpiresAt.IsZero() {
+		t.Fatalf("expected only the preview to expire, got %v and %v",
+			result.File("preview").ExpiresAt, result.File("export").ExpiresAt)
+	}
+
+	tusID := strings.Repeat("a", tusIDLength)
+	expiredTusID := strings.Repeat("b", tusIDLength)
+	writeFiles := map[string]bool{
+		".upload-stale":              true,
+		".upload-fresh":              false,
+		sidecarName("gone.txt"):      true,
+		tusID + ".part":              true,
+		expiredTusID + ".part":       false,
+		"." + expiredTusID + ".info": false,
+		"short.part":                 true,
+		sidecarName("recent.txt"):    false,
+	}
+	for name, stale := range writeFiles {
+		fp := filepath.Join(uploadDir, name)
+		content := text
+		if name == "."+expiredTusID+".info" {
+			content = []byte(`{"id":"` + expiredTusID + `","expires_at":"2000-01-01T00:00:00Z"}`)
+		}
+		if err := os.WriteFile(fp, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if stale {
+			os.Chtimes(fp, old, old)
+		}
+	}
+
+	var mu sync.Mutex
+	var removed []string
+	j := testTools.NewJanitor(JanitorOptions{
+		Dirs:      []string{uploadDir},
+		OrphanAge: time.Hour,
+		OnRemove: func(f RemovedFile) {
+			mu.Lock()
+			defer mu.Unlock()
+			removed = append(removed, string(f.Reason)+" "+f.Name)
+		},
+	})
+	if err := j.Sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(removed)
+	expected := []string{
+		"expired " + expiredTusID + ".part",
+		"expired preview.txt",
+		"orphaned " + sidecarName("gone.txt"),
+		"orphaned " + tusID + ".part",
+		"orphaned .upload-stale",
+	}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected removals %v, got %v", expected, removed)
+	}
+
+	var remaining []string
+	entries, _ := os.ReadDir(uploadDir)
+	for _, e := range entries {
+		remaining = append(remaining, e.Name())
+	}
+	expectedRemaining := []string{".upload-fresh", sidecarName("recent.txt"),
+		"export.txt", "short.part"}
+	sort.Strings(expectedRemaining)
+	if !reflect.DeepEqual(remaining, expectedRemaining) {
+		t.Errorf("expected %v to remain, got %v", expectedRemaining, remaining)
+	}
+}
+
+func TestJanitor_StartStop(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{UploadTTL: time.Nanosecond}
+
+	removed := make(chan RemovedFile, 1)
+	j := testTools.StartJanitor(JanitorOptions{
+		Dirs:     []string{uploadDir},
+		Interval: 10 * time.Millisecond,
+		OnRemove: func(f RemovedFile) { removed <- f },
+	})
+
+	uploadedFile, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "a.txt", []byte("some text")}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case f := <-removed:
+		if f.Name != uploadedFile.NewFileName || f.Reason != RemovalExpired {
+			t.Errorf("unexpected removal %+v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the janitor did not remove the expired upload")
+	}
+
+	j.Stop()
+	j.Stop()
+
+	if _, err := os.Stat(filepath.Join(uploadDir, uploadedFile.NewFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected the expired upload to be removed, got %v", err)
+	}
+
+	testTools.NewJanitor(JanitorOptions{}).Stop()
+}
+
+func TestTools_DownloadExpired(t *testing.T) {
+	for _, ttl := range []time.Duration{time.Nanosecond, time.Hour} {
+		uploadDir := t.TempDir()
+		testTools := Tools{UploadTTL: ttl}
+
+		uploadedFile, err := testTools.UploadOneFile(
+			newUploadRequest(t, testFormFile{"file", "a.txt", []byte("some text")}), uploadDir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status := http.StatusOK
+		if ttl == time.Nanosecond {
+			status = http.StatusNotFound
+		}
+
+		downloads := map[string]func(w http.ResponseWriter, r *http.Request){
+			"static file": func(w http.ResponseWriter, r *http.Request) {
+				testTools.DownloadStaticFile(w, r, filepath.Join(uploadDir, uploadedFile.NewFileName), "")
+			},
+			"root": func(w http.ResponseWriter, r *http.Request) {
+				testTools.NewDownloadRoot(uploadDir).Download(w, r, uploadedFile.NewFileName, "")
+			},
+			"zip": func(w http.ResponseWriter, r *http.Request) {
+				testTools.DownloadZip(w, r, nil,
+					[]ZipFile{{Path: filepath.Join(uploadDir, uploadedFile.NewFileName)}}, "")
+			},
+		}
+		for name, download := range downloads {
+			rr := httptest.NewRecorder()
+			download(rr, httptest.NewRequest("GET", "/", nil))
+			if rr.Code != status {
+				t.Errorf("%s with TTL %s: expected status %d, got %d", name, ttl, status, rr.Code)
+			}
+		}
+	}
+}
+
+func TestTools_UploadTTLPartialBatch(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{UploadTTL: time.Hour, AllowedFileTypes: []string{"image/jpeg"}}
+
+	files, err := testTools.UploadMultipleFiles(newUploadRequest(t,
+		testFormFile{"a", "photo.jpg", readTestImage(t)},
+		testFormFile{"b", "notes.txt", []byte("some text")}), uploadDir)
+	if err == nil || len(files) != 1 {
+		t.Fatalf("expected one kept file and an error, got %d files and %v", len(files), err)
+	}
+
+	record, err := testTools.NewManifest(uploadDir).Lookup(context.Background(), files[0].NewFileName)
+	if err != nil {
+		t.Fatalf("expected a sidecar for the kept file: %s", err)
+	}
+	if !record.ExpiresAt.Equal(files[0].ExpiresAt) {
+		t.Errorf("expected expiry %v, got %v", files[0].ExpiresAt, record.ExpiresAt)
+	}
+}
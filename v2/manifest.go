@@ -0,0 +1,233 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sidecarPrefix = "."
+	sidecarSuffix = ".meta.json"
+
+	RequestIDHeader = "X-Request-ID"
+)
+
+type FileRecord struct {
+	NewFileName      string              `json:"new_file_name"`
+	OriginalFileName string              `json:"original_file_name"`
+	ContentType      string              `json:"content_type"`
+	FileSize         int64               `json:"file_size"`
+	Hashes           map[string]string   `json:"hashes,omitempty"`
+	Variants         []string            `json:"variants,omitempty"`
+	Field            string              `json:"field,omitempty"`
+	FormValues       map[string][]string `json:"form_values,omitempty"`
+	RequestID        string              `json:"request_id,omitempty"`
+	UploadedAt       time.Time           `json:"uploaded_at"`
+	ExpiresAt        time.Time           `json:"expires_at,omitempty"`
+}
+
+// expired reports whether the file has outlived its TTL. Downloads treat it as
+// gone even before the janitor removes it.
+func (r *FileRecord) expired() bool {
+	return !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt)
+}
+
+// sidecarName returns the name of the metadata file kept next to name. The
+// leading dot keeps it apart from uploads, whose sanitized names never start
+// with one.
+func sidecarName(name string) string {
+	return sidecarPrefix + name + sidecarSuffix
+}
+
+func (t *Tools) writeSidecar(ctx context.Context, uploadDir string, f *UploadedFile,
+	values map[string][]string, requestID string) error {
+	record := &FileRecord{
+		NewFileName:      f.NewFileName,
+		OriginalFileName: f.OriginalFileName,
+		ContentType:      f.FileType,
+		FileSize:         f.FileSize,
+		Hashes:           f.Hashes,
+		Field:            f.field,
+		FormValues:       values,
+		RequestID:        requestID,
+		UploadedAt:       time.Now().UTC(),
+		ExpiresAt:        f.ExpiresAt,
+	}
+	for _, v := range f.Variants {
+		record.Variants = append(record.Variants, v.FileName)
+	}
+
+	out, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.storage().Put(ctx, storageKey(uploadDir, sidecarName(f.NewFileName)),
+		bytes.NewReader(out))
+	return err
+}
+
+// writeSidecars records files that need a sidecar: all of them when Sidecars
+// is set, and otherwise those that expire. A deduplicated file is shared with
+// earlier uploads, so its expiry is merged with theirs.
+func (t *Tools) writeSidecars(ctx context.Context, uploadDir string, files []*UploadedFile,
+	values map[string][]string, requestID string) error {
+	for _, f := range files {
+		var shared *FileRecord
+		if f.Deduplicated {
+			shared, _ = t.readSidecar(ctx, storageKey(uploadDir, sidecarName(f.NewFileName)))
+			f.ExpiresAt = sharedExpiry(shared, f.ExpiresAt)
+		}
+		if !t.Sidecars && f.ExpiresAt.IsZero() && shared == nil {
+			continue
+		}
+		if err := t.writeSidecar(ctx, uploadDir, f, values, requestID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedExpiry returns when a file kept by the upload recorded in shared and
+// by one expiring at expiresAt may go: never if either reference never
+// expires, otherwise at the later expiry. An earlier upload without a record
+// never expires.
+func sharedExpiry(shared *FileRecord, expiresAt time.Time) time.Time {
+	if shared == nil || shared.ExpiresAt.IsZero() || expiresAt.IsZero() {
+		return time.Time{}
+	}
+	if shared.ExpiresAt.After(expiresAt) {
+		return shared.ExpiresAt
+	}
+	return expiresAt
+}
+
+func (t *Tools) readSidecar(ctx context.Context, key string) (*FileRecord, error) {
+	content, err := t.getStored(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	return decodeRecord(content)
+}
+
+func decodeRecord(r io.Reader) (*FileRecord, error) {
+	var record FileRecord
+	if err := json.NewDecoder(io.LimitReader(r, 1<<20)).Decode(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Manifest gives access to the sidecar records of the uploads stored in one
+// directory.
+type Manifest struct {
+	tools *Tools
+	dir   string
+}
+
+func (t *Tools) NewManifest(uploadDir string) *Manifest {
+	return &Manifest{tools: t, dir: uploadDir}
+}
+
+// List returns the records of all uploads in the directory, ordered by
+// NewFileName.
+func (m *Manifest) List(ctx context.Context) ([]*FileRecord, error) {
+	files, err := m.tools.storage().List(ctx, m.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*FileRecord
+	for _, f := range files {
+		name := path.Base(f.Name)
+		if !strings.HasPrefix(name, sidecarPrefix) || !strings.HasSuffix(name, sidecarSuffix) {
+			continue
+		}
+
+		record, err := m.tools.readSidecar(ctx, storageKey(m.dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].NewFileName < records[j].NewFileName
+	})
+	return records, nil
+}
+
+func (m *Manifest) Lookup(ctx context.Context, name string) (*FileRecord, error) {
+	if !manifestName(name) {
+		return nil, notExist(name)
+	}
+	return m.tools.readSidecar(ctx, storageKey(m.dir, sidecarName(name)))
+}
+
+// Delete removes an upload together with its image variants and its record.
+func (m *Manifest) Delete(ctx context.Context, name string) error {
+	s := m.tools.storage()
+
+	if !manifestName(name) {
+		return notExist(name)
+	}
+
+	record, err := m.Lookup(ctx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	names := []string{name, sidecarName(name)}
+	if record != nil {
+		names = append(names, record.Variants...)
+	}
+
+	deleted := false
+	var errs []error
+	for _, n := range names {
+		err := s.Delete(ctx, storageKey(m.dir, n))
+		switch {
+		case err == nil:
+			deleted = true
+		case !errors.Is(err, fs.ErrNotExist):
+			errs = append(errs, err)
+		}
+	}
+
+	if !deleted && len(errs) == 0 {
+		return notExist(name)
+	}
+	return errors.Join(errs...)
+}
+
+// manifestName reports whether name can refer to an upload in the manifest
+// directory rather than to a path outside it.
+func manifestName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// lookupDownload finds the record for a file about to be downloaded from
+// pathName, or returns nil when there is none.
+func (t *Tools) lookupDownload(ctx context.Context, pathName string) *FileRecord {
+	dir, name := filepath.Split(pathName)
+
+	record, err := t.readSidecar(ctx, storageKey(dir, sidecarName(name)))
+	if err != nil {
+		return nil
+	}
+	return record
+}
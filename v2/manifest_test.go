@@ -0,0 +1,143 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	img := readTestImage(t)
+
+	backends := map[string]func(t *testing.T) (Storage, string){
+		"disk": func(t *testing.T) (Storage, string) { return nil, t.TempDir() },
+		"memory": func(t *testing.T) (Storage, string) {
+			return NewMemoryStorage(), "uploads"
+		},
+	}
+
+	for name, backend := range backends {
+		for _, stream := range []bool{false, true} {
+			storage, uploadDir := backend(t)
+			testTools := Tools{
+				Storage:        storage,
+				StreamUploads:  stream,
+				Sidecars:       true,
+				HashAlgorithms: []string{HashSHA256},
+			}
+
+			req := newUploadRequestWithValues(t, url.Values{"title": {"Holiday"}},
+				testFormFile{"photo", "beach.jpg", img},
+				testFormFile{"notes", "notes.txt", []byte("hello world")})
+			req.Header.Set(RequestIDHeader, "req-42")
+
+			uploadedFiles, err := testTools.UploadMultipleFiles(req, uploadDir)
+			if err != nil {
+				t.Fatalf("%s stream %v: %v", name, stream, err)
+			}
+
+			manifest := testTools.NewManifest(uploadDir)
+			records, err := manifest.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 2 {
+				t.Fatalf("%s stream %v: expected 2 records, got %d", name, stream, len(records))
+			}
+
+			for _, f := range uploadedFiles {
+				record, err := manifest.Lookup(context.Background(), f.NewFileName)
+				if err != nil {
+					t.Fatalf("%s stream %v: %v", name, stream, err)
+				}
+
+				if record.OriginalFileName != f.OriginalFileName || record.FileSize != f.FileSize ||
+					record.Hashes[HashSHA256] != f.Hashes[HashSHA256] || record.RequestID != "req-42" ||
+					record.UploadedAt.IsZero() {
+					t.Errorf("%s stream %v: unexpected record %+v", name, stream, record)
+				}
+				if v := record.FormValues["title"]; len(v) != 1 || v[0] != "Holiday" {
+					t.Errorf("%s stream %v: expected form values in record, got %v", name, stream, record.FormValues)
+				}
+				if f.OriginalFileName == "beach.jpg" && (record.ContentType != "image/jpeg" || record.Field != "photo") {
+					t.Errorf("%s stream %v: unexpected record %+v", name, stream, record)
+				}
+			}
+
+			deleted := uploadedFiles[0].NewFileName
+			if err := manifest.Delete(context.Background(), deleted); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := manifest.Lookup(context.Background(), deleted); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s stream %v: expected deleted record to be gone, got %v", name, stream, err)
+			}
+			if _, err := testTools.storage().Stat(context.Background(), storageKey(uploadDir, deleted)); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s stream %v: expected deleted file to be gone", name, stream)
+			}
+			if err := manifest.Delete(context.Background(), deleted); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s stream %v: expected error deleting twice, got %v", name, stream, err)
+			}
+
+			records, _ = manifest.List(context.Background())
+			if len(records) != 1 {
+				t.Errorf("%s stream %v: expected 1 record after delete, got %d", name, stream, len(records))
+			}
+		}
+	}
+}
+
+func TestManifest_LookupOutsideDir(t *testing.T) {
+	root := t.TempDir()
+	uploadDir := filepath.Join(root, "uploads")
+
+	testTools := Tools{Sidecars: true}
+	f, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "a.txt", []byte("hello")}), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := testTools.NewManifest(uploadDir)
+	for _, name := range []string{"../" + f.NewFileName, "..", ""} {
+		if _, err := manifest.Lookup(context.Background(), name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%q: expected not found, got %v", name, err)
+		}
+		if err := manifest.Delete(context.Background(), name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%q: expected not found, got %v", name, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, f.NewFileName)); err != nil {
+		t.Errorf("file outside the manifest directory was touched: %v", err)
+	}
+}
+
+func TestTools_DownloadStaticFileSidecar(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{Sidecars: true}
+
+	f, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "My Report.txt", []byte("hello world")}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	testTools.DownloadStaticFile(rr, req, filepath.Join(uploadDir, f.NewFileName), "")
+
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="My Report.txt"` {
+		t.Errorf("unexpected content disposition %q", cd)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if rr.Body.String() != "hello world" {
+		t.Errorf("unexpected body %q", rr.Body.String())
+	}
+}
@@ -0,0 +1,52 @@
+package toolkit
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type UploadPolicy struct {
+	AllowedFileTypes  []string
+	AllowedExtensions []string
+	MaxFileSize       int64
+	MinFiles          int
+	MaxFiles          int
+	Required          bool
+	TTL               time.Duration
+}
+
+func (p UploadPolicy) extensionAllowed(fileName string) bool {
+	if len(p.AllowedExtensions) == 0 {
+		return true
+	}
+
+	ext := strings.TrimPrefix(filepath.Ext(fileName), ".")
+	for _, x := range p.AllowedExtensions {
+		if strings.EqualFold(strings.TrimPrefix(x, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tools) checkFileCounts(counts map[string]int) error {
+	fields := make([]string, 0, len(t.UploadPolicies))
+	for field := range t.UploadPolicies {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		policy := t.UploadPolicies[field]
+
+		if policy.Required && counts[field] == 0 {
+			return &UploadError{Err: ErrMissingFile, Field: field}
+		}
+		if counts[field] < policy.MinFiles {
+			return &UploadError{Err: ErrTooFewFiles, Field: field, Limit: int64(policy.MinFiles)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package toolkit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTools_UploadPolicies(t *testing.T) {
+	img := readTestImage(t)
+	pdf := []byte("%PDF-1.4\n% test document\n")
+
+	policies := map[string]UploadPolicy{
+		"avatar": {
+			AllowedFileTypes:  []string{"image/jpeg", "image/png"},
+			AllowedExtensions: []string{"jpg", ".png"},
+			MaxFileSize:       int64(len(img)),
+			MaxFiles:          1,
+			Required:          true,
+		},
+		"documents": {
+			AllowedFileTypes:  []string{"application/pdf"},
+			AllowedExtensions: []string{"pdf"},
+			MinFiles:          2,
+			MaxFiles:          10,
+		},
+	}
+
+	var policyTests = []struct {
+		name          string
+		files         []testFormFile
+		maxAvatarSize int64
+		expectedErr   error
+		expectedField string
+	}{
+		{name: "valid form",
+			files: []testFormFile{{"avatar", "me.jpg", img},
+				{"documents", "a.pdf", pdf}, {"documents", "b.pdf", pdf}}},
+		{name: "too many avatars",
+			files: []testFormFile{{"avatar", "me.jpg", img}, {"avatar", "me2.jpg", img},
+				{"documents", "a.pdf", pdf}, {"documents", "b.pdf", pdf}},
+			expectedErr: ErrTooManyFiles, expectedField: "avatar"},
+		{name: "avatar too large",
+			files: []testFormFile{{"avatar", "me.jpg", img},
+				{"documents", "a.pdf", pdf}, {"documents", "b.pdf", pdf}},
+			maxAvatarSize: 1024,
+			expectedErr:   ErrFileTooLarge, expectedField: "avatar"},
+		{name: "wrong document type",
+			files: []testFormFile{{"avatar", "me.jpg", img},
+				{"documents", "a.pdf", img}, {"documents", "b.pdf", pdf}},
+			expectedErr: ErrFileTypeNotAllowed, expectedField: "documents"},
+		{name: "wrong document extension",
+			files: []testFormFile{{"avatar", "me.jpg", img},
+				{"documents", "a.txt", pdf}, {"documents", "b.pdf", pdf}},
+			expectedErr: ErrExtensionNotAllowed, expectedField: "documents"},
+		{name: "missing avatar",
+			files:       []testFormFile{{"documents", "a.pdf", pdf}, {"documents", "b.pdf", pdf}},
+			expectedErr: ErrMissingFile, expectedField: "avatar"},
+		{name: "too few documents",
+			files:       []testFormFile{{"avatar", "me.jpg", img}, {"documents", "a.pdf", pdf}},
+			expectedErr: ErrTooFewFiles, expectedField: "documents"},
+	}
+
+	for _, stream := range []bool{false, true} {
+		for _, e := range policyTests {
+			testPolicies := make(map[string]UploadPolicy)
+			for field, policy := range policies {
+				testPolicies[field] = policy
+			}
+			if e.maxAvatarSize > 0 {
+				avatar := testPolicies["avatar"]
+				avatar.MaxFileSize = e.maxAvatarSize
+				testPolicies["avatar"] = avatar
+			}
+
+			testTools := Tools{UploadPolicies: testPolicies, StreamUploads: stream}
+
+			uploadedFiles, err := testTools.UploadMultipleFiles(newUploadRequest(t, e.files...), t.TempDir())
+			if e.expectedErr == nil {
+				if err != nil {
+					t.Errorf("%s: unexpected error %v", e.name, err)
+				}
+				if len(uploadedFiles) != len(e.files) {
+					t.Errorf("%s: expected %d files, got %d", e.name, len(e.files), len(uploadedFiles))
+				}
+				continue
+			}
+
+			if !errors.Is(err, e.expectedErr) {
+				t.Errorf("%s (stream %v): expected error %v, got %v", e.name, stream, e.expectedErr, err)
+				continue
+			}
+			if !strings.Contains(err.Error(), e.expectedField) {
+				t.Errorf("%s: error does not name field %q: %v", e.name, e.expectedField, err)
+			}
+		}
+	}
+}
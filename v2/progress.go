@@ -0,0 +1,274 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProgressIDParam  = "upload_id"
+	ProgressIDHeader = "X-Upload-ID"
+
+	defaultProgressRetention = time.Minute
+)
+
+type UploadProgress struct {
+	ID            string    `json:"id"`
+	Field         string    `json:"field,omitempty"`
+	FileName      string    `json:"file_name,omitempty"`
+	FileBytes     int64     `json:"file_bytes"`
+	RequestBytes  int64     `json:"request_bytes"`
+	RequestLength int64     `json:"request_length"`
+	Files         int       `json:"files"`
+	Done          bool      `json:"done"`
+	Error         string    `json:"error,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ProgressRegistry keeps the latest progress of in-flight uploads in memory so
+// it can be served to clients while the upload request is still streaming.
+// Finished uploads stay visible for Retention, one minute by default.
+type ProgressRegistry struct {
+	Retention time.Duration
+
+	mu      sync.Mutex
+	uploads map[string]*progressEntry
+	version uint64
+	changed chan struct{}
+}
+
+type progressEntry struct {
+	progress UploadProgress
+	version  uint64
+}
+
+func NewProgressRegistry() *ProgressRegistry {
+	return &ProgressRegistry{}
+}
+
+func (p *ProgressRegistry) Get(id string) (UploadProgress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.uploads[id]
+	if !ok {
+		return UploadProgress{}, false
+	}
+	return entry.progress, true
+}
+
+func (p *ProgressRegistry) update(progress UploadProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.uploads == nil {
+		p.uploads = make(map[string]*progressEntry)
+	}
+
+	// Expired uploads are only swept when another one finishes, which keeps
+	// the per-read updates cheap.
+	if progress.Done {
+		retention := p.Retention
+		if retention <= 0 {
+			retention = defaultProgressRetention
+		}
+		for id, entry := range p.uploads {
+			u := entry.progress
+			if u.Done && progress.UpdatedAt.Sub(u.UpdatedAt) > retention {
+				delete(p.uploads, id)
+			}
+		}
+	}
+
+	p.version++
+	p.uploads[progress.ID] = &progressEntry{progress: progress, version: p.version}
+
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+// wait returns the current entry for id, which is nil while the upload is
+// unknown, along with a channel that is closed on the next update to any
+// upload.
+func (p *ProgressRegistry) wait(id string) (*progressEntry, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+
+	return p.uploads[id], p.changed
+}
+
+// ServeHTTP reports the progress of the upload named by the upload_id query
+// parameter or the X-Upload-ID header. Clients that accept text/event-stream
+// receive a Server-Sent Events stream until the upload is done; everyone else
+// gets the current progress as JSON.
+func (p *ProgressRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := progressID(r)
+	if id == "" {
+		http.Error(w, "missing upload id", http.StatusBadRequest)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		p.serveEvents(w, r, id)
+		return
+	}
+
+	progress, ok := p.Get(id)
+	if !ok {
+		http.Error(w, "unknown upload id", http.StatusNotFound)
+		return
+	}
+
+	out, err := json.Marshal(progress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(out)
+}
+
+func (p *ProgressRegistry) serveEvents(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var last uint64
+	for {
+		// The stream may be opened before the upload starts, so an unknown id
+		// just waits for its first update.
+		entry, changed := p.wait(id)
+
+		if entry != nil && entry.version != last {
+			progress := entry.progress
+			data, err := json.Marshal(progress)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+			last = entry.version
+
+			if progress.Done {
+				return
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func progressID(r *http.Request) string {
+	if id := r.URL.Query().Get(ProgressIDParam); id != "" {
+		return id
+	}
+	return r.Header.Get(ProgressIDHeader)
+}
+
+// progressTracker accumulates the byte counts of a single upload request and
+// publishes every change to the callback and the registry.
+type progressTracker struct {
+	callback func(UploadProgress)
+	registry *ProgressRegistry
+	progress UploadProgress
+}
+
+func (t *Tools) newProgressTracker(r *http.Request) *progressTracker {
+	if t.OnProgress == nil && t.ProgressRegistry == nil {
+		return nil
+	}
+
+	pt := &progressTracker{
+		callback: t.OnProgress,
+		progress: UploadProgress{ID: progressID(r), RequestLength: r.ContentLength},
+	}
+	if pt.progress.ID != "" {
+		pt.registry = t.ProgressRegistry
+	}
+
+	pt.publish()
+	return pt
+}
+
+func (pt *progressTracker) publish() {
+	pt.progress.UpdatedAt = time.Now()
+
+	if pt.callback != nil {
+		pt.callback(pt.progress)
+	}
+	if pt.registry != nil {
+		pt.registry.update(pt.progress)
+	}
+}
+
+func (pt *progressTracker) startFile(part *uploadPart) {
+	pt.progress.Field = part.field
+	pt.progress.FileName = part.fileName
+	pt.progress.FileBytes = 0
+	pt.publish()
+}
+
+func (pt *progressTracker) finishFile() {
+	pt.progress.Files++
+	pt.publish()
+}
+
+func (pt *progressTracker) finish(err error) {
+	pt.progress.Done = true
+	if err != nil {
+		pt.progress.Error = err.Error()
+	}
+	pt.publish()
+}
+
+func (pt *progressTracker) body(rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{&progressReader{r: rc, count: &pt.progress.RequestBytes, tracker: pt}, rc}
+}
+
+func (pt *progressTracker) file(r io.Reader) io.Reader {
+	return &progressReader{r: r, count: &pt.progress.FileBytes, tracker: pt}
+}
+
+type progressReader struct {
+	r       io.Reader
+	count   *int64
+	tracker *progressTracker
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		*pr.count += int64(n)
+		pr.tracker.publish()
+	}
+	return n, err
+}
@@ -0,0 +1,144 @@
+package toolkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTools_UploadProgressCallback(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		var updates []UploadProgress
+		testTools := Tools{
+			StreamUploads: stream,
+			OnProgress:    func(p UploadProgress) { updates = append(updates, p) },
+		}
+
+		img := readTestImage(t)
+		req := newUploadRequest(t,
+			testFormFile{"file", "one.jpg", img},
+			testFormFile{"file", "two.txt", []byte("hello world")})
+
+		if _, err := testTools.UploadMultipleFiles(req, t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(updates) < 4 {
+			t.Fatalf("stream %v: expected progress updates, got %d", stream, len(updates))
+		}
+
+		var imageBytes int64
+		for i, u := range updates {
+			if i > 0 && u.RequestBytes < updates[i-1].RequestBytes {
+				t.Errorf("stream %v: request bytes went backwards", stream)
+			}
+			if u.FileName == "one.jpg" && u.FileBytes > imageBytes {
+				imageBytes = u.FileBytes
+			}
+		}
+		if imageBytes != int64(len(img)) {
+			t.Errorf("stream %v: expected %d file bytes for one.jpg, got %d", stream, len(img), imageBytes)
+		}
+
+		last := updates[len(updates)-1]
+		if !last.Done || last.Files != 2 || last.Error != "" {
+			t.Errorf("stream %v: unexpected final progress %+v", stream, last)
+		}
+		if last.RequestBytes != req.ContentLength || last.RequestLength != req.ContentLength {
+			t.Errorf("stream %v: expected %d request bytes, got %d of %d", stream,
+				req.ContentLength, last.RequestBytes, last.RequestLength)
+		}
+	}
+}
+
+func TestProgressRegistry_JSON(t *testing.T) {
+	registry := NewProgressRegistry()
+	testTools := Tools{ProgressRegistry: registry, AllowedFileTypes: []string{"image/jpeg"}}
+
+	req := newUploadRequest(t, testFormFile{"file", "notes.txt", []byte("hello world")})
+	req.Header.Set(ProgressIDHeader, "abc123")
+	if _, err := testTools.UploadOneFile(req, t.TempDir()); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+
+	rr := httptest.NewRecorder()
+	registry.ServeHTTP(rr, httptest.NewRequest("GET", "/progress?upload_id=abc123", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+
+	var progress UploadProgress
+	if err := json.Unmarshal(rr.Body.Bytes(), &progress); err != nil {
+		t.Fatal(err)
+	}
+	if !progress.Done || progress.Error == "" || progress.FileName != "notes.txt" {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	var statusTests = []struct {
+		target       string
+		expectedCode int
+	}{
+		{"/progress", http.StatusBadRequest},
+		{"/progress?upload_id=unknown", http.StatusNotFound},
+	}
+
+	for _, e := range statusTests {
+		rr := httptest.NewRecorder()
+		registry.ServeHTTP(rr, httptest.NewRequest("GET", e.target, nil))
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status %d, got %d", e.target, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestProgressRegistry_Events(t *testing.T) {
+	registry := NewProgressRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"?upload_id=abc123", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	testTools := Tools{ProgressRegistry: registry, StreamUploads: true}
+	upload := newUploadRequest(t, testFormFile{"file", "big.bin", bytes.Repeat([]byte("x"), 256<<10)})
+	upload.URL.RawQuery = "upload_id=abc123"
+	if _, err := testTools.UploadOneFile(upload, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []UploadProgress
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var p UploadProgress
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, p)
+	}
+
+	if len(events) == 0 {
+		t.Fatal("expected progress events")
+	}
+	last := events[len(events)-1]
+	if !last.Done || last.ID != "abc123" || last.FileBytes != 256<<10 {
+		t.Errorf("unexpected final event %+v", last)
+	}
+}
@@ -0,0 +1,203 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrQuotaBytes        = errors.New("the upload directory is over its size quota")
+	ErrQuotaFiles        = errors.New("the upload directory is over its file count quota")
+	ErrInsufficientSpace = errors.New("there is not enough free disk space for the upload")
+)
+
+// QuotaOptions limits what a single upload directory may hold. MaxBytes and
+// MaxFiles count the files directly inside the directory, ignoring metadata
+// sidecars, tus upload records and temporary files; the data of partial tus
+// uploads does count. MinFreeBytes is checked with statfs before a request is
+// accepted and only applies to uploads stored on local disk.
+//
+// Usage is read once per request, so concurrent uploads to the same directory
+// can each use up the remaining quota.
+type QuotaOptions struct {
+	MaxBytes     int64
+	MaxFiles     int
+	MinFreeBytes int64
+}
+
+type QuotaError struct {
+	Err   error
+	Dir   string
+	Limit int64
+	Used  int64
+	Free  int64
+}
+
+func (e *QuotaError) Error() string {
+	if e.Err == ErrInsufficientSpace {
+		return fmt.Sprintf("%s: %s (%d bytes free, %d bytes reserved)", e.Dir, e.Err, e.Free, e.Limit)
+	}
+	return fmt.Sprintf("%s: %s (used %d of %d)", e.Dir, e.Err, e.Used, e.Limit)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return e.Err
+}
+
+func (e *QuotaError) StatusCode() int {
+	return http.StatusInsufficientStorage
+}
+
+// quotaTracker holds the usage of one upload directory while a request adds
+// files to it.
+type quotaTracker struct {
+	dir   string
+	opts  *QuotaOptions
+	bytes int64
+	files int
+}
+
+// newQuotaTracker reads the current usage of uploadDir and rejects the
+// request when the directory is already full or the disk has no room for
+// incoming more bytes. It returns nil when no quota is set.
+func (t *Tools) newQuotaTracker(ctx context.Context, uploadDir string,
+	incoming int64) (*quotaTracker, error) {
+	opts := t.Quota
+	if opts == nil {
+		return nil, nil
+	}
+
+	incoming = max(incoming, 0)
+
+	if opts.MinFreeBytes > 0 {
+		if err := t.checkFreeSpace(uploadDir, incoming); err != nil {
+			return nil, err
+		}
+	}
+
+	q := &quotaTracker{dir: uploadDir, opts: opts}
+	if opts.MaxBytes <= 0 && opts.MaxFiles <= 0 {
+		return q, nil
+	}
+
+	files, err := t.storage().List(ctx, uploadDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if quotaIgnored(path.Base(f.Name)) {
+			continue
+		}
+		q.bytes += f.Size
+		q.files++
+	}
+
+	if opts.MaxBytes > 0 && q.bytes >= opts.MaxBytes {
+		return nil, q.error(ErrQuotaBytes)
+	}
+	if opts.MaxFiles > 0 && q.files >= opts.MaxFiles {
+		return nil, q.error(ErrQuotaFiles)
+	}
+
+	return q, nil
+}
+
+// quotaIgnored reports whether a stored file is bookkeeping rather than an
+// upload. Sidecars, tus records and temporary files are hidden, which uploads
+// never are.
+func quotaIgnored(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+func (q *quotaTracker) error(err error) *QuotaError {
+	quotaErr := &QuotaError{Err: err, Dir: q.dir}
+	if err == ErrQuotaFiles {
+		quotaErr.Limit, quotaErr.Used = int64(q.opts.MaxFiles), int64(q.files)
+	} else {
+		quotaErr.Limit, quotaErr.Used = q.opts.MaxBytes, q.bytes
+	}
+	return quotaErr
+}
+
+// reserve checks that a file of a known size still fits.
+func (q *quotaTracker) reserve(size int64) error {
+	if q.opts.MaxBytes > 0 && q.bytes+size > q.opts.MaxBytes {
+		return q.error(ErrQuotaBytes)
+	}
+	return q.addFile()
+}
+
+func (q *quotaTracker) addFile() error {
+	if q.opts.MaxFiles > 0 && q.files >= q.opts.MaxFiles {
+		return q.error(ErrQuotaFiles)
+	}
+	q.files++
+	return nil
+}
+
+func (q *quotaTracker) reader(r io.Reader) io.Reader {
+	if q.opts.MaxBytes <= 0 {
+		return r
+	}
+	return &quotaReader{r: r, q: q}
+}
+
+type quotaReader struct {
+	r io.Reader
+	q *quotaTracker
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	qr.q.bytes += int64(n)
+	if qr.q.bytes > qr.q.opts.MaxBytes {
+		return n, qr.q.error(ErrQuotaBytes)
+	}
+	return n, err
+}
+
+// checkFreeSpace fails when storing incoming more bytes under uploadDir would
+// leave less than MinFreeBytes on its filesystem. Backends other than local
+// disk are not checked.
+func (t *Tools) checkFreeSpace(uploadDir string, incoming int64) error {
+	dir := uploadDir
+	switch s := t.Storage.(type) {
+	case nil:
+	case *DiskStorage:
+		dir = s.path(uploadDir)
+	default:
+		return nil
+	}
+
+	// The directory may not exist yet, so ask about its closest ancestor.
+	for {
+		free, err := diskFreeSpace(dir)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+		if os.IsNotExist(err) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if free < incoming+t.Quota.MinFreeBytes {
+			return &QuotaError{
+				Err:   ErrInsufficientSpace,
+				Dir:   uploadDir,
+				Limit: t.Quota.MinFreeBytes,
+				Free:  free,
+			}
+		}
+		return nil
+	}
+}
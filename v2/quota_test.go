@@ -0,0 +1,161 @@
+package toolkit
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestTools_UploadQuota(t *testing.T) {
+	text := []byte("0123456789")
+
+	var quotaTests = []struct {
+		name        string
+		quota       QuotaOptions
+		existing    int
+		files       []testFormFile
+		expectedErr error
+		stored      int
+	}{
+		{name: "within quota", quota: QuotaOptions{MaxBytes: 30, MaxFiles: 3}, existing: 1,
+			files: []testFormFile{{"file", "a.txt", text}, {"file", "b.txt", text}}, stored: 3},
+		{name: "file count", quota: QuotaOptions{MaxFiles: 2}, existing: 1,
+			files:       []testFormFile{{"file", "a.txt", text}, {"file", "b.txt", text}},
+			expectedErr: ErrQuotaFiles, stored: 2},
+		{name: "already full", quota: QuotaOptions{MaxFiles: 1}, existing: 1,
+			files:       []testFormFile{{"file", "a.txt", text}},
+			expectedErr: ErrQuotaFiles, stored: 1},
+		{name: "bytes", quota: QuotaOptions{MaxBytes: 25}, existing: 1,
+			files:       []testFormFile{{"file", "a.txt", text}, {"file", "b.txt", text}},
+			expectedErr: ErrQuotaBytes, stored: 2},
+		{name: "archive entries", quota: QuotaOptions{MaxFiles: 2},
+			files: []testFormFile{{"file", "bundle.zip", newTestZip(t,
+				testArchiveEntry{name: "a.txt", content: text},
+				testArchiveEntry{name: "b.txt", content: text},
+				testArchiveEntry{name: "c.txt", content: text})}},
+			expectedErr: ErrQuotaFiles},
+		{name: "free space", quota: QuotaOptions{MinFreeBytes: math.MaxInt64 / 2},
+			files:       []testFormFile{{"file", "a.txt", text}},
+			expectedErr: ErrInsufficientSpace},
+		{name: "enough free space", quota: QuotaOptions{MinFreeBytes: 1},
+			files: []testFormFile{{"file", "a.txt", text}}, stored: 1},
+	}
+
+	for _, e := range quotaTests {
+		for _, stream := range []bool{false, true} {
+			uploadDir := t.TempDir()
+			for i := 0; i < e.existing; i++ {
+				os.WriteFile(filepath.Join(uploadDir, "existing"+strconv.Itoa(i)), text, 0644)
+			}
+
+			quota := e.quota
+			testTools := Tools{
+				Quota:           &quota,
+				StreamUploads:   stream,
+				Sidecars:        true,
+				ExtractArchives: &ArchiveOptions{},
+			}
+
+			_, err := testTools.UploadMultipleFiles(newUploadRequest(t, e.files...), uploadDir)
+			if !errors.Is(err, e.expectedErr) {
+				t.Errorf("%s stream %v: expected error %v, got %v", e.name, stream, e.expectedErr, err)
+			}
+
+			var quotaErr *QuotaError
+			if e.expectedErr != nil && (!errors.As(err, &quotaErr) ||
+				quotaErr.StatusCode() != http.StatusInsufficientStorage) {
+				t.Errorf("%s stream %v: expected a quota error, got %v", e.name, stream, err)
+			}
+
+			var stored int
+			entries, _ := os.ReadDir(uploadDir)
+			for _, entry := range entries {
+				if !quotaIgnored(entry.Name()) {
+					stored++
+				}
+			}
+			if stored != e.stored {
+				t.Errorf("%s stream %v: expected %d stored files, got %d", e.name, stream, e.stored, stored)
+			}
+		}
+	}
+}
+
+func TestTools_TusQuota(t *testing.T) {
+	uploadDir := t.TempDir()
+	os.WriteFile(filepath.Join(uploadDir, "existing"), make([]byte, 90), 0644)
+
+	testTools := Tools{Quota: &QuotaOptions{MaxBytes: 100}}
+	handler := testTools.NewTusHandler(uploadDir, "/files/")
+
+	var tusTests = []struct {
+		length       string
+		expectedCode int
+	}{
+		{"20", http.StatusInsufficientStorage},
+		{"10", http.StatusCreated},
+	}
+
+	for _, e := range tusTests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, tusRequest("POST", "/files/", nil,
+			map[string]string{"Upload-Length": e.length}))
+		if rr.Code != e.expectedCode {
+			t.Errorf("length %s: expected status %d, got %d", e.length, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestTools_TusQuotaCompleted(t *testing.T) {
+	uploadDir := t.TempDir()
+
+	testTools := Tools{Quota: &QuotaOptions{MaxFiles: 2}}
+	handler := testTools.NewTusHandler(uploadDir, "/files/")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("POST", "/files/", nil, map[string]string{"Upload-Length": "5"}))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rr.Code)
+	}
+	location := rr.Header().Get("Location")
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("PATCH", location, []byte("hello"), map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+
+	// The completed upload is one file; its record does not count.
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("POST", "/files/", nil, map[string]string{"Upload-Length": "5"}))
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestQuotaIgnored(t *testing.T) {
+	var ignoredTests = []struct {
+		name     string
+		expected bool
+	}{
+		{".photo.jpg.meta.json", true},
+		{".upload-abc", true},
+		{".abc123.info", true},
+		{"abc123.part", false},
+		{"photo.jpg", false},
+	}
+
+	for _, e := range ignoredTests {
+		if got := quotaIgnored(e.name); got != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultS3PartSize = 8 << 20
+
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PartSize  int64
+	Client    *http.Client
+}
+
+func (s *S3Storage) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+func (s *S3Storage) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+func (s *S3Storage) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	key := cleanKey(name)
+
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	}
+
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		res, err := s.do(ctx, "PUT", key, nil, buf[:n], nil)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return s.putMultipart(ctx, key, r, buf)
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3Storage) putMultipart(ctx context.Context, key string, r io.Reader,
+	buf []byte) (int64, error) {
+	res, err := s.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	uploadID := url.Values{"uploadId": {initiated.UploadID}}
+
+	abort := func(err error) (int64, error) {
+		res, abortErr := s.do(context.WithoutCancel(ctx), "DELETE", key, uploadID, nil, nil)
+		if abortErr == nil {
+			res.Body.Close()
+		}
+		return 0, err
+	}
+
+	var parts []s3CompletedPart
+	var total int64
+	chunk := buf
+
+	for partNumber := 1; len(chunk) > 0; partNumber++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {initiated.UploadID},
+		}
+
+		res, err := s.do(ctx, "PUT", key, query, chunk, nil)
+		if err != nil {
+			return abort(err)
+		}
+		res.Body.Close()
+
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: res.Header.Get("ETag")})
+		total += int64(len(chunk))
+
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+		chunk = buf[:n]
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+
+	res, err = s.do(ctx, "POST", key, uploadID, body, nil)
+	if err != nil {
+		return abort(err)
+	}
+	defer res.Body.Close()
+
+	// S3 may report a failed completion with a 200 status and an error body.
+	var completed struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&completed); err == nil &&
+		completed.XMLName.Local == "Error" {
+		return abort(fmt.Errorf("s3: %s: %s", completed.Code, completed.Message))
+	}
+
+	return total, nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	key := cleanKey(name)
+
+	res, err := s.do(ctx, "GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{s: s, ctx: ctx, key: key, body: res.Body, size: res.ContentLength}, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	key := cleanKey(name)
+
+	res, err := s.do(ctx, "HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+
+	return &FileInfo{Name: key, Size: res.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, name string) error {
+	res, err := s.do(ctx, "DELETE", cleanKey(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Rename(ctx context.Context, oldName, newName string) error {
+	source := "/" + s3Escape(s.Bucket, false) + "/" + s3Escape(cleanKey(oldName), false)
+
+	res, err := s.do(ctx, "PUT", cleanKey(newName), nil, nil,
+		http.Header{"X-Amz-Copy-Source": {source}})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return s.Delete(ctx, oldName)
+}
+
+func (s *S3Storage) List(ctx context.Context, dir string) ([]*FileInfo, error) {
+	prefix := cleanKey(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var files []*FileInfo
+	token := ""
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := s.do(ctx, "GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			files = append(files, &FileInfo{Name: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return files, nil
+}
+
+func (s *S3Storage) do(ctx context.Context, method, key string, query url.Values,
+	body []byte, header http.Header) (*http.Response, error) {
+	uri := "/" + s3Escape(s.Bucket, false)
+	if key != "" {
+		uri += "/" + s3Escape(key, false)
+	}
+
+	u, err := url.Parse(strings.TrimRight(s.Endpoint, "/") + uri)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	s.sign(req, uri, body, time.Now().UTC())
+
+	res, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, notExist(key)
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		_ = xml.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&s3Err)
+		if s3Err.Code == "" {
+			s3Err.Code = res.Status
+		}
+		return nil, fmt.Errorf("s3: %s %s: %s %s", method, key, s3Err.Code, s3Err.Message)
+	}
+
+	return res, nil
+}
+
+func (s *S3Storage) sign(req *http.Request, uri string, body []byte, now time.Time) {
+	const algorithm = "AWS4-HMAC-SHA256"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region() + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, s.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+type s3Object struct {
+	s      *S3Storage
+	ctx    context.Context
+	key    string
+	body   io.ReadCloser
+	size   int64
+	offset int64
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.body == nil {
+		if o.offset >= o.size {
+			return 0, io.EOF
+		}
+
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		res, err := o.s.do(o.ctx, "GET", o.key, nil, nil, header)
+		if err != nil {
+			return 0, err
+		}
+		o.body = res.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative seek offset")
+	}
+
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
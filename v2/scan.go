@@ -0,0 +1,185 @@
+package toolkit
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultClamdChunkSize = 64 << 10
+
+var ErrFileInfected = errors.New("the uploaded file is infected")
+
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*ScanResult, error)
+}
+
+type InfectedFileError struct {
+	Field         string
+	FileName      string
+	Signature     string
+	QuarantinedAs string
+}
+
+func (e *InfectedFileError) Error() string {
+	msg := fmt.Sprintf("%s: %s (%s)", e.FileName, ErrFileInfected, e.Signature)
+	if e.Field != "" {
+		msg = fmt.Sprintf("field %q: %s", e.Field, msg)
+	}
+	return msg
+}
+
+func (e *InfectedFileError) Unwrap() error {
+	return ErrFileInfected
+}
+
+func (e *InfectedFileError) StatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+type ClamdScanner struct {
+	Network   string
+	Address   string
+	Timeout   time.Duration
+	ChunkSize int
+}
+
+func (c *ClamdScanner) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+		if strings.HasPrefix(c.Address, "/") {
+			network = "unix"
+		}
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultClamdChunkSize
+	}
+	buf := make([]byte, 4+chunkSize)
+
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return nil, c.replyError(conn, err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, c.replyError(conn, err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// replyError prefers the reason clamd gives when it closes the connection
+// early, such as exceeding its stream size limit, over the write error.
+func (c *ClamdScanner) replyError(conn net.Conn, err error) error {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, _ := bufio.NewReader(conn).ReadString(0)
+	if reply = strings.TrimRight(reply, "\x00\n"); reply != "" {
+		return fmt.Errorf("clamd: %s", reply)
+	}
+	return err
+}
+
+func parseClamdReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return &ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+func (t *Tools) scanStaged(ctx context.Context, key string, uploadedFile *UploadedFile,
+	part *uploadPart) error {
+	s := t.storage()
+
+	content, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	result, err := t.Scanner.Scan(ctx, content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	if !result.Infected {
+		return nil
+	}
+
+	infected := &InfectedFileError{
+		Field:     part.field,
+		FileName:  part.fileName,
+		Signature: result.Signature,
+	}
+
+	if t.QuarantineDir != "" {
+		infected.QuarantinedAs = storageKey(t.QuarantineDir,
+			t.RandomString(12)+"-"+uploadedFile.NewFileName)
+
+		if err := moveStored(ctx, s, key, infected.QuarantinedAs); err != nil {
+			return errors.Join(infected, err)
+		}
+	}
+
+	return infected
+}
@@ -0,0 +1,157 @@
+package toolkit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// fakeClamd answers INSTREAM requests, reporting any stream that contains the
+// EICAR test string as infected.
+func fakeClamd(t *testing.T, network, address string) string {
+	t.Helper()
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				command, err := r.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+
+				if bytes.Contains(data, eicar) {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+
+	scanners := map[string]*ClamdScanner{
+		"tcp":  {Address: fakeClamd(t, "tcp", "127.0.0.1:0"), ChunkSize: 16},
+		"unix": {Address: fakeClamd(t, "unix", socket)},
+	}
+
+	for name, scanner := range scanners {
+		result, err := scanner.Scan(context.Background(), strings.NewReader("hello world"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if result.Infected {
+			t.Errorf("%s: clean file reported as infected", name)
+		}
+
+		result, err = scanner.Scan(context.Background(),
+			io.MultiReader(strings.NewReader("prefix "), bytes.NewReader(eicar)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !result.Infected || result.Signature != "Eicar-Signature" {
+			t.Errorf("%s: unexpected result %+v", name, result)
+		}
+	}
+
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("expected error for clamd error reply")
+	}
+}
+
+func TestTools_UploadScanning(t *testing.T) {
+	scanner := &ClamdScanner{Address: fakeClamd(t, "tcp", "127.0.0.1:0")}
+
+	for _, quarantine := range []bool{false, true} {
+		uploadDir := t.TempDir()
+		quarantineDir := filepath.Join(t.TempDir(), "quarantine")
+
+		testTools := Tools{Scanner: scanner}
+		if quarantine {
+			testTools.QuarantineDir = quarantineDir
+		}
+
+		uploadedFile, err := testTools.UploadOneFile(
+			newUploadRequest(t, testFormFile{"file", "notes.txt", []byte("hello world")}), uploadDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(uploadDir, uploadedFile.NewFileName)); err != nil {
+			t.Errorf("expected clean file to be stored: %v", err)
+		}
+
+		_, err = testTools.UploadOneFile(
+			newUploadRequest(t, testFormFile{"file", "virus.txt", eicar}), uploadDir)
+
+		var infected *InfectedFileError
+		if !errors.As(err, &infected) || !errors.Is(err, ErrFileInfected) {
+			t.Fatalf("expected infected file error, got %v", err)
+		}
+		if infected.Signature != "Eicar-Signature" || infected.FileName != "virus.txt" {
+			t.Errorf("unexpected error details %+v", infected)
+		}
+
+		entries, _ := os.ReadDir(uploadDir)
+		if len(entries) != 1 {
+			t.Errorf("expected infected file to be kept out of the upload directory, found %d files", len(entries))
+		}
+
+		quarantined, _ := os.ReadDir(quarantineDir)
+		if quarantine {
+			if len(quarantined) != 1 || infected.QuarantinedAs == "" {
+				t.Fatal("expected infected file to be quarantined")
+			}
+			data, _ := os.ReadFile(infected.QuarantinedAs)
+			if !bytes.Equal(data, eicar) {
+				t.Error("quarantined file content does not match")
+			}
+		} else if len(quarantined) != 0 || infected.QuarantinedAs != "" {
+			t.Error("expected no quarantine without a quarantine directory")
+		}
+	}
+}
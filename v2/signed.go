@@ -0,0 +1,226 @@
+package toolkit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signedURLVersion = "1"
+	defaultSignedTTL = 15 * time.Minute
+)
+
+var (
+	ErrNoSigningKeys        = errors.New("no URL signing keys are configured")
+	ErrMalformedSignedURL   = errors.New("the signed URL is malformed")
+	ErrInvalidSignature     = errors.New("the signed URL signature is invalid")
+	ErrSignedURLExpired     = errors.New("the signed URL has expired")
+	ErrSignedClientMismatch = errors.New("the signed URL was issued to a different client")
+)
+
+// SigningOptions turns on signed download URLs. Keys signs new URLs with its
+// current key and verifies them with whichever key they name, so old links
+// keep working until their key is dropped. ClientIP returns the address a
+// request comes from and defaults to the host of RemoteAddr; set it when the
+// server runs behind a proxy. TTL is used for URLs without an expiry and
+// defaults to 15 minutes.
+type SigningOptions struct {
+	Keys     KeyProvider
+	ClientIP func(r *http.Request) string
+	TTL      time.Duration
+}
+
+func (o *SigningOptions) clientIP(r *http.Request) string {
+	if o.ClientIP != nil {
+		return o.ClientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SignedURL describes a download link. Path is the slash-separated path of the
+// file below the directory of the SignedDownloadHandler. The link stops
+// working at ExpiresAt, is downloaded as DisplayName when it is set, and only
+// works for ClientIP when that is set.
+type SignedURL struct {
+	Path        string
+	ExpiresAt   time.Time
+	DisplayName string
+	ClientIP    string
+}
+
+// SignURL returns a link to s below baseURL, the URL the SignedDownloadHandler
+// is served at, signed with the current key.
+func (t *Tools) SignURL(ctx context.Context, baseURL string, s *SignedURL) (string, error) {
+	opts := t.URLSigning
+	if opts == nil || opts.Keys == nil {
+		return "", ErrNoSigningKeys
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+
+	signed := *s
+	signed.Path = strings.TrimPrefix(signed.Path, "/")
+	if !fs.ValidPath(signed.Path) || signed.Path == "." {
+		return "", fmt.Errorf("%w: invalid path %q", ErrMalformedSignedURL, s.Path)
+	}
+	if signed.ExpiresAt.IsZero() {
+		ttl := opts.TTL
+		if ttl <= 0 {
+			ttl = defaultSignedTTL
+		}
+		signed.ExpiresAt = time.Now().Add(ttl)
+	}
+	if signed.ClientIP != "" {
+		ip, err := netip.ParseAddr(signed.ClientIP)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid client IP %q", ErrMalformedSignedURL, s.ClientIP)
+		}
+		signed.ClientIP = ip.Unmap().String()
+	}
+
+	id, key, err := opts.Keys.CurrentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := signed.values(id)
+	query.Set("sig", base64.RawURLEncoding.EncodeToString(signed.sign(query, key)))
+
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + signed.Path
+	u.RawPath = ""
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// VerifyURL checks the signature of a link made by SignURL, whose path is
+// r.URL.Path with any base path already stripped, and returns what it was
+// signed for. Tampered links and links signed with an unknown key fail with
+// ErrInvalidSignature, outdated ones with ErrSignedURLExpired and those used
+// from another address than the one they are bound to with
+// ErrSignedClientMismatch.
+func (t *Tools) VerifyURL(r *http.Request) (*SignedURL, error) {
+	opts := t.URLSigning
+	if opts == nil || opts.Keys == nil {
+		return nil, ErrNoSigningKeys
+	}
+
+	query := r.URL.Query()
+	sig, sigErr := base64.RawURLEncoding.DecodeString(query.Get("sig"))
+	expires, expiresErr := strconv.ParseInt(query.Get("expires"), 10, 64)
+	s := &SignedURL{
+		Path:        strings.TrimPrefix(r.URL.Path, "/"),
+		ExpiresAt:   time.Unix(expires, 0),
+		DisplayName: query.Get("name"),
+		ClientIP:    query.Get("ip"),
+	}
+	if len(sig) == 0 || sigErr != nil || expiresErr != nil || query.Get("v") != signedURLVersion ||
+		!fs.ValidPath(s.Path) || s.Path == "." {
+		return nil, ErrMalformedSignedURL
+	}
+
+	id := query.Get("kid")
+	key, err := opts.Keys.Key(r.Context(), id)
+	if errors.Is(err, ErrUnknownKey) {
+		return nil, ErrInvalidSignature
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(sig, s.sign(s.values(id), key)) {
+		return nil, ErrInvalidSignature
+	}
+
+	if !time.Now().Before(s.ExpiresAt) {
+		return nil, ErrSignedURLExpired
+	}
+	if s.ClientIP != "" {
+		ip, err := netip.ParseAddr(opts.clientIP(r))
+		if err != nil || ip.Unmap().String() != s.ClientIP {
+			return nil, ErrSignedClientMismatch
+		}
+	}
+	return s, nil
+}
+
+// values returns the query parameters of the link other than the signature.
+func (s *SignedURL) values(keyID string) url.Values {
+	v := url.Values{}
+	v.Set("v", signedURLVersion)
+	v.Set("expires", strconv.FormatInt(s.ExpiresAt.Unix(), 10))
+	v.Set("kid", keyID)
+	if s.DisplayName != "" {
+		v.Set("name", s.DisplayName)
+	}
+	if s.ClientIP != "" {
+		v.Set("ip", s.ClientIP)
+	}
+	return v
+}
+
+// sign covers the escaped path and the encoded parameters, so no field can
+// spill into another.
+func (s *SignedURL) sign(v url.Values, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(url.PathEscape(s.Path)))
+	mac.Write([]byte{'?'})
+	mac.Write([]byte(v.Encode()))
+	return mac.Sum(nil)
+}
+
+// SignedDownloadHandler serves the files below a directory to requests that
+// carry a valid signature made by SignURL, through DownloadStaticFile. Mount
+// it with http.StripPrefix when it is not served at the root.
+type SignedDownloadHandler struct {
+	tools *Tools
+	dir   string
+}
+
+func (t *Tools) NewSignedDownloadHandler(dir string) *SignedDownloadHandler {
+	return &SignedDownloadHandler{tools: t, dir: dir}
+}
+
+func (h *SignedDownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, err := h.tools.VerifyURL(r)
+	switch {
+	case errors.Is(err, ErrMalformedSignedURL):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrSignedURLExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrSignedClientMismatch):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	h.tools.DownloadStaticFile(w, r, filepath.Join(h.dir, filepath.FromSlash(s.Path)), s.DisplayName)
+}
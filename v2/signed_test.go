@@ -0,0 +1,161 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTools_SignedURL(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "reports"), 0755)
+	if err := os.WriteFile(filepath.Join(dir, "reports", "q1 report.txt"), []byte("report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testKeys()
+	testTools := Tools{URLSigning: &SigningOptions{Keys: keys}}
+
+	var signedTests = []struct {
+		name        string
+		url         SignedURL
+		rotate      bool
+		drop        bool
+		tamper      func(u *url.URL)
+		remoteAddr  string
+		status      int
+		disposition string
+		expectedErr error
+	}{
+		{name: "valid", url: SignedURL{Path: "reports/q1 report.txt"}, status: http.StatusOK,
+			disposition: "attachment"},
+		{name: "display name", url: SignedURL{Path: "reports/q1 report.txt", DisplayName: "résumé.txt"},
+			status: http.StatusOK, disposition: `attachment; filename="resume.txt"; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`},
+		{name: "expired", url: SignedURL{Path: "reports/q1 report.txt", ExpiresAt: time.Now().Add(-time.Second)},
+			status: http.StatusGone, expectedErr: ErrSignedURLExpired},
+		{name: "extended", url: SignedURL{Path: "reports/q1 report.txt", ExpiresAt: time.Now().Add(-time.Second)},
+			tamper: func(u *url.URL) { setQuery(u, "expires", "9999999999") },
+			status: http.StatusForbidden, expectedErr: ErrInvalidSignature},
+		{name: "other path", url: SignedURL{Path: "reports/q1 report.txt"},
+			tamper: func(u *url.URL) { u.Path = "/files/reports/other.txt" },
+			status: http.StatusForbidden, expectedErr: ErrInvalidSignature},
+		{name: "other name", url: SignedURL{Path: "reports/q1 report.txt", DisplayName: "a.txt"},
+			tamper: func(u *url.URL) { setQuery(u, "name", "b.exe") },
+			status: http.StatusForbidden, expectedErr: ErrInvalidSignature},
+		{name: "unbound", url: SignedURL{Path: "reports/q1 report.txt", ClientIP: "192.0.2.1"},
+			tamper: func(u *url.URL) { setQuery(u, "ip", "") },
+			status: http.StatusForbidden, expectedErr: ErrInvalidSignature},
+		{name: "bad signature", url: SignedURL{Path: "reports/q1 report.txt"},
+			tamper: func(u *url.URL) { setQuery(u, "sig", "AAAA") },
+			status: http.StatusForbidden, expectedErr: ErrInvalidSignature},
+		{name: "missing signature", url: SignedURL{Path: "reports/q1 report.txt"},
+			tamper: func(u *url.URL) { setQuery(u, "sig", "") },
+			status: http.StatusBadRequest, expectedErr: ErrMalformedSignedURL},
+		{name: "client ip", url: SignedURL{Path: "reports/q1 report.txt", ClientIP: "192.0.2.1"},
+			remoteAddr: "192.0.2.1:4000", status: http.StatusOK},
+		{name: "mapped client ip", url: SignedURL{Path: "reports/q1 report.txt", ClientIP: "::ffff:192.0.2.1"},
+			remoteAddr: "192.0.2.1:4000", status: http.StatusOK},
+		{name: "other client", url: SignedURL{Path: "reports/q1 report.txt", ClientIP: "192.0.2.1"},
+			remoteAddr: "198.51.100.7:4000", status: http.StatusForbidden, expectedErr: ErrSignedClientMismatch},
+		{name: "rotated key", url: SignedURL{Path: "reports/q1 report.txt"}, rotate: true, status: http.StatusOK},
+		{name: "dropped key", url: SignedURL{Path: "reports/q1 report.txt"}, rotate: true, drop: true,
+			status: http.StatusForbidden, expectedErr: ErrInvalidSignature},
+		{name: "missing file", url: SignedURL{Path: "reports/missing.txt"}, status: http.StatusNotFound},
+	}
+
+	for _, e := range signedTests {
+		keys.CurrentID = "k1"
+		keys.Keys = testKeys().Keys
+
+		link, err := testTools.SignURL(context.Background(), "https://example.com/files/", &e.url)
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+		if e.rotate {
+			keys.CurrentID = "k2"
+		}
+		if e.drop {
+			delete(keys.Keys, "k1")
+		}
+
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(u.Path, "/files/reports/") {
+			t.Errorf("%s: unexpected link %s", e.name, link)
+		}
+		if e.tamper != nil {
+			e.tamper(u)
+		}
+
+		req := httptest.NewRequest("GET", u.String(), nil)
+		if e.remoteAddr != "" {
+			req.RemoteAddr = e.remoteAddr
+		}
+
+		rr := httptest.NewRecorder()
+		http.StripPrefix("/files", testTools.NewSignedDownloadHandler(dir)).ServeHTTP(rr, req)
+
+		if rr.Code != e.status {
+			t.Errorf("%s: expected status %d, got %d (%s)", e.name, e.status, rr.Code, rr.Body.String())
+			continue
+		}
+		if e.status == http.StatusOK && rr.Body.String() != "report" {
+			t.Errorf("%s: unexpected body %q", e.name, rr.Body.String())
+		}
+		if e.disposition != "" && rr.Header().Get("Content-Disposition") != e.disposition {
+			t.Errorf("%s: expected disposition %s, got %s", e.name, e.disposition,
+				rr.Header().Get("Content-Disposition"))
+		}
+
+		if e.expectedErr != nil {
+			req.URL.Path = strings.TrimPrefix(req.URL.Path, "/files")
+			if _, err := testTools.VerifyURL(req); !errors.Is(err, e.expectedErr) {
+				t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+			}
+		}
+	}
+}
+
+func TestTools_SignURLErrors(t *testing.T) {
+	var signTests = []struct {
+		name        string
+		tools       Tools
+		url         SignedURL
+		expectedErr error
+	}{
+		{name: "no keys", url: SignedURL{Path: "a.txt"}, expectedErr: ErrNoSigningKeys},
+		{name: "traversal", tools: Tools{URLSigning: &SigningOptions{Keys: testKeys()}},
+			url: SignedURL{Path: "../a.txt"}, expectedErr: ErrMalformedSignedURL},
+		{name: "bad ip", tools: Tools{URLSigning: &SigningOptions{Keys: testKeys()}},
+			url: SignedURL{Path: "a.txt", ClientIP: "localhost"}, expectedErr: ErrMalformedSignedURL},
+		{name: "unknown current key", tools: Tools{URLSigning: &SigningOptions{
+			Keys: &StaticKeys{CurrentID: "k3", Keys: testKeys().Keys}}},
+			url: SignedURL{Path: "a.txt"}, expectedErr: ErrUnknownKey},
+	}
+
+	for _, e := range signTests {
+		if _, err := e.tools.SignURL(context.Background(), "/files", &e.url); !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
+
+func setQuery(u *url.URL, key, value string) {
+	q := u.Query()
+	if value == "" {
+		q.Del(key)
+	} else {
+		q.Set(key, value)
+	}
+	u.RawQuery = q.Encode()
+}
@@ -0,0 +1,118 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+)
+
+// FileMeta describes an uploaded file that is about to be written to a sink.
+// The file has already passed the type checks; its size and digests are
+// checked while it is written.
+type FileMeta struct {
+	Field            string
+	OriginalFileName string
+	NewFileName      string
+	FileType         string
+	Header           textproto.MIMEHeader
+}
+
+// FileSink returns the writer an uploaded file is copied to. When the upload
+// fails part way, a writer with a CloseWithError method, such as
+// *io.PipeWriter, is closed through it so it can discard what it received;
+// other writers are simply closed.
+type FileSink func(meta *FileMeta) (io.WriteCloser, error)
+
+// UploadToSink saves the files of a multipart form to writers returned by sink
+// instead of a directory. Size limits, type and extension checks, digests and
+// malware scanning apply as for UploadForm. Steps that need the stored file,
+// namely image processing, archive extraction, content addressing, quotas,
+// sidecars and AllOrNothing, do not apply.
+func (t *Tools) UploadToSink(r *http.Request, sink FileSink,
+	rename ...bool) (*UploadResult, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	return t.upload(r, &uploadBatch{renameFile: renameFile, sink: sink})
+}
+
+func (t *Tools) writeSink(ctx context.Context, part *uploadPart, f *UploadedFile,
+	r io.Reader) (int64, error) {
+	w, err := part.sink(&FileMeta{
+		Field:            part.field,
+		OriginalFileName: f.OriginalFileName,
+		NewFileName:      f.NewFileName,
+		FileType:         f.FileType,
+		Header:           part.header,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var scan *streamScan
+	if t.Scanner != nil {
+		scan = t.startScan(ctx, part)
+		r = io.TeeReader(r, scan.w)
+	}
+
+	n, err := io.Copy(w, r)
+
+	if scan != nil {
+		// A scanner that stops reading early closes the pipe, so its own
+		// result explains the failed copy better.
+		scanErr := scan.wait(err)
+		if scanErr != nil && (err == nil || errors.Is(err, io.ErrClosedPipe)) {
+			err = scanErr
+		}
+	}
+
+	if err != nil {
+		if c, ok := w.(interface{ CloseWithError(error) error }); ok {
+			_ = c.CloseWithError(err)
+		} else {
+			_ = w.Close()
+		}
+		return n, contextError(ctx, err)
+	}
+	return n, w.Close()
+}
+
+// streamScan scans a file while it is being written to a sink. There is no
+// stored copy to quarantine, so an infected file is only reported.
+type streamScan struct {
+	w    *io.PipeWriter
+	part *uploadPart
+	done chan error
+}
+
+func (t *Tools) startScan(ctx context.Context, part *uploadPart) *streamScan {
+	pr, pw := io.Pipe()
+	scan := &streamScan{w: pw, part: part, done: make(chan error, 1)}
+
+	go func() {
+		result, err := t.Scanner.Scan(ctx, pr)
+		pr.Close()
+
+		if err == nil && result.Infected {
+			err = &InfectedFileError{
+				Field:     part.field,
+				FileName:  part.fileName,
+				Signature: result.Signature,
+			}
+		}
+		scan.done <- err
+	}()
+
+	return scan
+}
+
+// wait ends the scanned stream with copyErr and returns the outcome of the
+// scan.
+func (s *streamScan) wait(copyErr error) error {
+	_ = s.w.CloseWithError(copyErr)
+	return <-s.done
+}
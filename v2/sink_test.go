@@ -0,0 +1,92 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+type testSink struct {
+	bytes.Buffer
+	meta     *FileMeta
+	closed   bool
+	abortErr error
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *testSink) CloseWithError(err error) error {
+	s.abortErr = err
+	return s.Close()
+}
+
+func TestTools_UploadToSink(t *testing.T) {
+	text := []byte("hello world")
+	errSink := errors.New("sink unavailable")
+
+	var sinkTests = []struct {
+		name        string
+		tools       Tools
+		files       []testFormFile
+		sinkErr     error
+		expectedErr error
+		aborted     bool
+	}{
+		{name: "plain text", files: []testFormFile{{"file", "notes.txt", text}}},
+		{name: "type not allowed", tools: Tools{AllowedFileTypes: []string{"image/png"}},
+			files: []testFormFile{{"file", "notes.txt", text}}, expectedErr: ErrFileTypeNotAllowed},
+		{name: "too large", tools: Tools{MaxFileSize: 5},
+			files: []testFormFile{{"file", "notes.txt", text}}, expectedErr: ErrFileTooLarge, aborted: true},
+		{name: "infected", tools: Tools{Scanner: &ClamdScanner{Address: fakeClamd(t, "tcp", "127.0.0.1:0")}},
+			files: []testFormFile{{"file", "virus.txt", eicar}}, expectedErr: ErrFileInfected, aborted: true},
+		{name: "clean scan", tools: Tools{Scanner: &ClamdScanner{Address: fakeClamd(t, "tcp", "127.0.0.1:0")}},
+			files: []testFormFile{{"file", "notes.txt", text}}},
+		{name: "sink error", files: []testFormFile{{"file", "notes.txt", text}},
+			sinkErr: errSink, expectedErr: errSink},
+	}
+
+	for _, e := range sinkTests {
+		for _, stream := range []bool{false, true} {
+			var sinks []*testSink
+			sink := func(meta *FileMeta) (io.WriteCloser, error) {
+				if e.sinkErr != nil {
+					return nil, e.sinkErr
+				}
+				s := &testSink{meta: meta}
+				sinks = append(sinks, s)
+				return s, nil
+			}
+
+			e.tools.StreamUploads = stream
+			result, err := e.tools.UploadToSink(newUploadRequest(t, e.files...), sink, false)
+			if !errors.Is(err, e.expectedErr) {
+				t.Errorf("%s stream %v: expected error %v, got %v", e.name, stream, e.expectedErr, err)
+			}
+
+			if e.expectedErr == nil {
+				if len(sinks) != 1 || !sinks[0].closed || sinks[0].abortErr != nil {
+					t.Fatalf("%s stream %v: expected one closed sink, got %+v", e.name, stream, sinks)
+				}
+				if !bytes.Equal(sinks[0].Bytes(), e.files[0].content) {
+					t.Errorf("%s stream %v: sink received %q", e.name, stream, sinks[0].Bytes())
+				}
+				meta := sinks[0].meta
+				if meta.Field != "file" || meta.NewFileName != e.files[0].fileName ||
+					meta.FileType != "text/plain; charset=utf-8" {
+					t.Errorf("%s stream %v: unexpected meta %+v", e.name, stream, meta)
+				}
+				if len(result.Files) != 1 || result.Files[0].FileSize != int64(len(e.files[0].content)) {
+					t.Errorf("%s stream %v: unexpected result %+v", e.name, stream, result.Files)
+				}
+			}
+
+			if e.aborted && (len(sinks) != 1 || sinks[0].abortErr == nil) {
+				t.Errorf("%s stream %v: expected the sink to be aborted", e.name, stream)
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package toolkit
+
+import "errors"
+
+func diskFreeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package toolkit
+
+import (
+	"math"
+
+	"golang.org/x/sys/unix"
+)
+
+func diskFreeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	if free > math.MaxInt64 {
+		return math.MaxInt64, nil
+	}
+	return int64(free), nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package toolkit
+
+import (
+	"math"
+
+	"golang.org/x/sys/windows"
+)
+
+func diskFreeSpace(dir string) (int64, error) {
+	name, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &free, nil, nil); err != nil {
+		return 0, err
+	}
+
+	if free > math.MaxInt64 {
+		return math.MaxInt64, nil
+	}
+	return int64(free), nil
+}
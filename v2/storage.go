@@ -0,0 +1,388 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+type Storage interface {
+	Put(ctx context.Context, name string, r io.Reader) (int64, error)
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	Stat(ctx context.Context, name string) (*FileInfo, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context, dir string) ([]*FileInfo, error)
+}
+
+type Renamer interface {
+	Rename(ctx context.Context, oldName, newName string) error
+}
+
+func moveStored(ctx context.Context, s Storage, oldName, newName string) error {
+	if r, ok := s.(Renamer); ok {
+		return r.Rename(ctx, oldName, newName)
+	}
+
+	content, err := s.Get(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Put(ctx, newName, content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	return s.Delete(ctx, oldName)
+}
+
+func (t *Tools) storage() Storage {
+	s := t.baseStorage()
+	if t.Encryption != nil {
+		return &encryptedStorage{Storage: s, opts: t.Encryption}
+	}
+	return s
+}
+
+// baseStorage returns the configured storage without encryption.
+func (t *Tools) baseStorage() Storage {
+	if t.Storage == nil {
+		return &DiskStorage{}
+	}
+	return t.Storage
+}
+
+// statStored and getStored read a stored file. Files stored before
+// Encryption was turned on are read as they are, as DownloadRoot does.
+func (t *Tools) statStored(ctx context.Context, name string) (*FileInfo, error) {
+	info, err := t.storage().Stat(ctx, name)
+	if errors.Is(err, ErrNotEncrypted) {
+		return t.baseStorage().Stat(ctx, name)
+	}
+	return info, err
+}
+
+func (t *Tools) getStored(ctx context.Context, name string) (io.ReadCloser, error) {
+	content, err := t.storage().Get(ctx, name)
+	if errors.Is(err, ErrNotEncrypted) {
+		return t.baseStorage().Get(ctx, name)
+	}
+	return content, err
+}
+
+func (t *Tools) serveStoredFile(w http.ResponseWriter, r *http.Request, pathName string) {
+	info, err := t.statStored(r.Context(), pathName)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	content, err := t.getStored(r.Context(), pathName)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	serveContent(w, r, path.Base(pathName), info.Size, info.ModTime, content)
+}
+
+// serveContent writes content, using http.ServeContent when it can seek. For
+// other readers it answers If-Modified-Since and otherwise sends the whole
+// file, with its length when size is not negative.
+func serveContent(w http.ResponseWriter, r *http.Request, name string, size int64,
+	modTime time.Time, content io.Reader) {
+	if rs, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, modTime, rs)
+		return
+	}
+
+	if !modTime.IsZero() && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err == nil && !modTime.Truncate(time.Second).After(since) {
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+	}
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		_, _ = io.Copy(w, content)
+	}
+}
+
+func storageKey(dir, name string) string {
+	return path.Join(filepath.ToSlash(dir), name)
+}
+
+func cleanKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+func notExist(name string) error {
+	return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+type DiskStorage struct {
+	Root string
+}
+
+func (d *DiskStorage) path(name string) string {
+	return filepath.Join(d.Root, filepath.FromSlash(name))
+}
+
+func (d *DiskStorage) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	fp := d.path(name)
+	dir := filepath.Dir(fp)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(dir, tempFilePrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	tempPath := f.Name()
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, fp)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return 0, err
+	}
+
+	syncDir(dir)
+
+	return n, nil
+}
+
+func (d *DiskStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if _, err := d.Stat(ctx, name); err != nil {
+		return nil, err
+	}
+	return os.Open(d.path(name))
+}
+
+func (d *DiskStorage) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	stat, err := os.Stat(d.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, notExist(name)
+	}
+
+	return &FileInfo{Name: name, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (d *DiskStorage) Delete(ctx context.Context, name string) error {
+	return os.Remove(d.path(name))
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
+
+func (d *DiskStorage) Rename(ctx context.Context, oldName, newName string) error {
+	newPath := d.path(newName)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(d.path(oldName), newPath)
+}
+
+func (d *DiskStorage) List(ctx context.Context, dir string) ([]*FileInfo, error) {
+	entries, err := os.ReadDir(d.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*FileInfo
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		stat, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		files = append(files, &FileInfo{
+			Name:    storageKey(dir, e.Name()),
+			Size:    stat.Size(),
+			ModTime: stat.ModTime(),
+		})
+	}
+	return files, nil
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]memoryFile)}
+}
+
+func (m *MemoryStorage) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.files == nil {
+		m.files = make(map[string]memoryFile)
+	}
+	m.files[cleanKey(name)] = memoryFile{data: data, modTime: time.Now()}
+
+	return int64(len(data)), nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (m *MemoryStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.files[cleanKey(name)]
+	if !ok {
+		return nil, notExist(name)
+	}
+	return memoryReader{bytes.NewReader(f.data)}, nil
+}
+
+func (m *MemoryStorage) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key := cleanKey(name)
+	f, ok := m.files[key]
+	if !ok {
+		return nil, notExist(name)
+	}
+	return &FileInfo{Name: key, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (m *MemoryStorage) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := cleanKey(name)
+	if _, ok := m.files[key]; !ok {
+		return notExist(name)
+	}
+	delete(m.files, key)
+	return nil
+}
+
+func (m *MemoryStorage) Rename(ctx context.Context, oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldKey := cleanKey(oldName)
+	f, ok := m.files[oldKey]
+	if !ok {
+		return notExist(oldName)
+	}
+	delete(m.files, oldKey)
+	m.files[cleanKey(newName)] = f
+	return nil
+}
+
+func (m *MemoryStorage) List(ctx context.Context, dir string) ([]*FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dir = cleanKey(dir)
+
+	var files []*FileInfo
+	for key, f := range m.files {
+		parent := path.Dir(key)
+		if parent == "." {
+			parent = ""
+		}
+		if parent != dir {
+			continue
+		}
+		files = append(files, &FileInfo{Name: key, Size: int64(len(f.data)), ModTime: f.modTime})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
@@ -0,0 +1,137 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func testStorage(t *testing.T, name string, s Storage) {
+	ctx := context.Background()
+
+	n, err := s.Put(ctx, "uploads/hello.txt", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("%s: put failed: %v", name, err)
+	}
+	if n != 11 {
+		t.Errorf("%s: expected 11 bytes written, got %d", name, n)
+	}
+
+	if _, err := s.Put(ctx, "uploads/nested/skip.txt", strings.NewReader("x")); err != nil {
+		t.Fatalf("%s: put failed: %v", name, err)
+	}
+
+	info, err := s.Stat(ctx, "uploads/hello.txt")
+	if err != nil {
+		t.Fatalf("%s: stat failed: %v", name, err)
+	}
+	if info.Size != 11 {
+		t.Errorf("%s: wrong size from stat: %d", name, info.Size)
+	}
+
+	rc, err := s.Get(ctx, "uploads/hello.txt")
+	if err != nil {
+		t.Fatalf("%s: get failed: %v", name, err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "hello world" {
+		t.Errorf("%s: wrong content %q", name, data)
+	}
+
+	files, err := s.List(ctx, "uploads")
+	if err != nil {
+		t.Fatalf("%s: list failed: %v", name, err)
+	}
+	if len(files) != 1 || files[0].Name != "uploads/hello.txt" {
+		t.Errorf("%s: unexpected listing %v", name, files)
+	}
+
+	if err := s.Delete(ctx, "uploads/hello.txt"); err != nil {
+		t.Errorf("%s: delete failed: %v", name, err)
+	}
+
+	if _, err := s.Stat(ctx, "uploads/hello.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s: expected not exist error after delete, got %v", name, err)
+	}
+
+	if _, err := s.Get(ctx, "uploads/missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s: expected not exist error for missing file, got %v", name, err)
+	}
+}
+
+func TestDiskStorage(t *testing.T) {
+	testStorage(t, "disk", &DiskStorage{Root: t.TempDir()})
+}
+
+func TestDiskStorage_PutFailure(t *testing.T) {
+	root := t.TempDir()
+	s := &DiskStorage{Root: root}
+
+	failing := io.MultiReader(strings.NewReader("partial"),
+		iotest.ErrReader(errors.New("connection reset")))
+
+	if _, err := s.Put(context.Background(), "file.txt", failing); err == nil {
+		t.Fatal("expected error")
+	}
+
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 0 {
+		t.Errorf("expected no files after failed put, found %d", len(entries))
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, "memory", NewMemoryStorage())
+}
+
+func TestTools_UploadToStorage(t *testing.T) {
+	img := readTestImage(t)
+	storage := NewMemoryStorage()
+
+	testTools := Tools{Storage: storage}
+
+	uploadedFile, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "image.jpg", img}), "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pathName := "uploads/" + uploadedFile.NewFileName
+
+	info, err := storage.Stat(context.Background(), pathName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(img)) {
+		t.Errorf("wrong stored size %d", info.Size)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	testTools.DownloadStaticFile(rr, req, pathName, "download.jpg")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d", rr.Code)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), img) {
+		t.Error("downloaded content does not match upload")
+	}
+	if rr.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("wrong content type %q", rr.Header().Get("Content-Type"))
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, req, "uploads/missing.jpg", "download.jpg")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing file, got %d", rr.Code)
+	}
+}
@@ -2,25 +2,55 @@ package toolkit
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
-	"path/filepath"
+	"path"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
 type Tools struct {
-	MaxFileSize        int64
-	AllowedFileTypes   []string
-	MaxJSONSize        int64
-	AllowUnknownFields bool
+	MaxFileSize         int64
+	MaxRequestSize      int64
+	AllowedFileTypes    []string
+	VerifyExtensions    bool
+	StreamUploads       bool
+	Storage             Storage
+	HashAlgorithms      []string
+	VerifyDigests       bool
+	ContentAddressed    bool
+	AllOrNothing        bool
+	UploadPolicies      map[string]UploadPolicy
+	ImageProcessing     *ImageOptions
+	Scanner             Scanner
+	QuarantineDir       string
+	OnProgress          func(UploadProgress)
+	ProgressRegistry    *ProgressRegistry
+	MaxFileNameLength   int
+	OnCollision         CollisionPolicy
+	ExtractArchives     *ArchiveOptions
+	Sidecars            bool
+	Quota               *QuotaOptions
+	FileTimeout         time.Duration
+	FileIdleTimeout     time.Duration
+	Encryption          *EncryptionOptions
+	UploadTTL           time.Duration
+	Disposition         DispositionType
+	ZipCompressionLevel int
+	URLSigning          *SigningOptions
+	MaxJSONSize         int64
+	AllowUnknownFields  bool
 }
 
 func (t *Tools) RandomString(size int) string {
@@ -35,103 +65,166 @@ func (t *Tools) RandomString(size int) string {
 type UploadedFile struct {
 	NewFileName      string
 	OriginalFileName string
+	FileType         string
 	FileSize         int64
+	Hashes           map[string]string
+	Deduplicated     bool
+	Width            int
+	Height           int
+	Variants         []*ImageVariantFile
+	ExpiresAt        time.Time
+
+	field     string
+	extracted []*UploadedFile
+	heldKey   string
+}
+
+// files returns the entries extracted from an uploaded archive, or the file
+// itself for any other upload.
+func (f *UploadedFile) files() []*UploadedFile {
+	if f.extracted != nil {
+		return f.extracted
+	}
+	return []*UploadedFile{f}
 }
 
 func (t *Tools) UploadMultipleFiles(r *http.Request, uploadDir string,
 	rename ...bool) ([]*UploadedFile, error) {
+	result, err := t.UploadForm(r, uploadDir, rename...)
+	if result == nil {
+		return nil, err
+	}
+	return result.Files, err
+}
+
+// UploadForm saves the files of a multipart form like UploadMultipleFiles and
+// also returns its text fields.
+func (t *Tools) UploadForm(r *http.Request, uploadDir string,
+	rename ...bool) (*UploadResult, error) {
 	renameFile := true
 	if len(rename) > 0 {
 		renameFile = rename[0]
 	}
 
-	var uploadedFiles []*UploadedFile
+	if t.Storage == nil {
+		err := t.CreateDirIfNotExists(uploadDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	quota, err := t.newQuotaTracker(r.Context(), uploadDir, r.ContentLength)
+	if err != nil {
+		return nil, err
+	}
 
+	return t.upload(r, &uploadBatch{
+		uploadDir:  uploadDir,
+		renameFile: renameFile,
+		quota:      quota,
+	})
+}
+
+// upload saves the files of the form in r as batch describes.
+func (t *Tools) upload(r *http.Request, batch *uploadBatch) (*UploadResult, error) {
 	if t.MaxFileSize == 0 {
 		t.MaxFileSize = 1073741824
 	}
 
-	err := t.CreateDirIfNotExists(uploadDir)
-	if err != nil {
-		return nil, err
+	var body *contextReader
+	if t.wrapsBody(r.Context()) {
+		body = newContextReader(r.Context(), r.Body, t.FileIdleTimeout)
+		defer body.stop()
+		r.Body = body
 	}
 
-	err = r.ParseMultipartForm(t.MaxFileSize)
-	if err != nil {
-		return nil, errors.New("the uploaded file is too large")
+	progress := t.newProgressTracker(r)
+	if progress != nil {
+		r.Body = progress.body(r.Body)
 	}
 
-	for _, fHeaders := range r.MultipartForm.File {
-		for _, hdr := range fHeaders {
-			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
-				var uploadedFile UploadedFile
-				infile, err := hdr.Open()
-				if err != nil {
-					return nil, err
-				}
-				defer infile.Close()
+	if t.MaxRequestSize > 0 {
+		r.Body = http.MaxBytesReader(nil, r.Body, t.MaxRequestSize)
+	}
 
-				buff := make([]byte, 512)
-				_, err = infile.Read(buff)
-				if err != nil {
-					return nil, err
-				}
+	batch.counts = make(map[string]int)
+	batch.body = body
+	batch.progress = progress
 
-				allowed := false
-				fileType := http.DetectContentType(buff)
-
-				if len(t.AllowedFileTypes) > 0 {
-					for _, x := range t.AllowedFileTypes {
-						if strings.EqualFold(x, fileType) {
-							allowed = true
-						}
-					}
-				} else {
-					allowed = true
-				}
+	var err error
+	if t.StreamUploads {
+		err = t.streamMultipleFiles(r, batch)
+	} else {
+		err = t.parseMultipleFiles(r, batch)
+	}
 
-				if !allowed {
-					return nil, errors.New("the uploaded file type is not permitted")
-				}
+	if err == nil {
+		err = t.checkFileCounts(batch.counts)
+	}
 
-				_, err = infile.Seek(0, 0)
-				if err != nil {
-					return nil, err
-				}
+	if err == nil {
+		err = t.commitHeld(r.Context(), batch.uploadDir, batch.files)
+	}
 
-				uploadedFile.OriginalFileName = hdr.Filename
+	// Files kept after a failure still get their sidecars, or the janitor
+	// would never remove the ones that expire.
+	if batch.sink == nil && (err == nil || !t.AllOrNothing) {
+		sidecarErr := t.writeSidecars(context.WithoutCancel(r.Context()), batch.uploadDir,
+			batch.files, batch.values, r.Header.Get(RequestIDHeader))
+		if err == nil {
+			err = sidecarErr
+		}
+	}
 
-				if renameFile {
-					uploadedFile.NewFileName = fmt.Sprintf("%s%s",
-						t.RandomString(12), filepath.Ext(hdr.Filename))
-				} else {
-					uploadedFile.NewFileName = hdr.Filename
-				}
+	if progress != nil {
+		progress.finish(err)
+	}
 
-				var outfile *os.File
-				defer outfile.Close()
-
-				if outfile, err = os.Create(filepath.Join(uploadDir,
-					uploadedFile.NewFileName)); err != nil {
-					return nil, err
-				} else {
-					fileSize, err := io.Copy(outfile, infile)
-					if err != nil {
-						return nil, err
-					}
-					uploadedFile.FileSize = fileSize
-				}
+	if err != nil && t.AllOrNothing && batch.sink == nil {
+		t.removeUploadedFiles(context.WithoutCancel(r.Context()), batch.uploadDir, batch.files)
+		return nil, err
+	}
 
-				uploadedFiles = append(uploadedFiles, &uploadedFile)
+	return newUploadResult(batch), err
+}
 
-				return uploadedFiles, nil
-			}(uploadedFiles)
+func (t *Tools) parseMultipleFiles(r *http.Request, batch *uploadBatch) error {
+	err := r.ParseMultipartForm(t.MaxFileSize)
+	if err != nil {
+		return contextError(r.Context(), uploadError(err))
+	}
+	batch.values = r.MultipartForm.Value
+
+	// The form only keeps the order of files within a field, so fields are
+	// saved in name order to keep results stable.
+	fields := make([]string, 0, len(r.MultipartForm.File))
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		for _, hdr := range r.MultipartForm.File[field] {
+			err := func() error {
+				infile, err := hdr.Open()
+				if err != nil {
+					return err
+				}
+				defer infile.Close()
+
+				return t.addUploadedFile(r.Context(), batch, &uploadPart{
+					field:    field,
+					fileName: hdr.Filename,
+					header:   hdr.Header,
+					r:        infile,
+				})
+			}()
 			if err != nil {
-				return uploadedFiles, err
+				return err
 			}
 		}
 	}
-	return uploadedFiles, nil
+	return nil
 }
 
 func (t *Tools) UploadOneFile(r *http.Request, uploadDir string,
@@ -146,6 +239,10 @@ func (t *Tools) UploadOneFile(r *http.Request, uploadDir string,
 		return nil, err
 	}
 
+	if len(files) == 0 {
+		return nil, &UploadError{Err: ErrNoFiles}
+	}
+
 	return files[0], nil
 }
 
@@ -177,10 +274,51 @@ func (t *Tools) Slugify(s string) (string, error) {
 
 func (t *Tools) DownloadStaticFile(w http.ResponseWriter,
 	r *http.Request, pathName, displayName string) {
-	w.Header().Set("Content-Disposition",
-		fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+	// Uploads with a TTL have a sidecar even when Sidecars is off.
+	if record := t.lookupDownload(r.Context(), pathName); record != nil {
+		if record.expired() {
+			http.NotFound(w, r)
+			return
+		}
+		if t.Sidecars {
+			if displayName == "" {
+				displayName = t.SanitizeFileName(record.OriginalFileName)
+			}
+			if record.ContentType != "" {
+				w.Header().Set("Content-Type", record.ContentType)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Disposition", ContentDisposition(t.Disposition, displayName))
+
+	if t.Storage == nil && t.Encryption == nil {
+		http.ServeFile(w, r, pathName)
+		return
+	}
 
-	http.ServeFile(w, r, pathName)
+	t.serveStoredFile(w, r, pathName)
+}
+
+// DownloadFS sends the file at name in fsys, such as an embed.FS, the way
+// DownloadStaticFile sends one from disk. name is checked as described for
+// DownloadRoot.
+func (t *Tools) DownloadFS(w http.ResponseWriter, r *http.Request, fsys fs.FS,
+	name, displayName string) {
+	t.NewDownloadFS(fsys).Download(w, r, name, displayName)
+}
+
+// DownloadContent sends content as a file called name, last modified at
+// modTime, with range and conditional requests handled by http.ServeContent.
+// The name is used when displayName is empty.
+func (t *Tools) DownloadContent(w http.ResponseWriter, r *http.Request, name string,
+	modTime time.Time, content io.ReadSeeker, displayName string) {
+	if displayName == "" {
+		displayName = path.Base(name)
+	}
+
+	w.Header().Set("Content-Disposition", ContentDisposition(t.Disposition, displayName))
+	http.ServeContent(w, r, name, modTime, content)
 }
 
 type JSONResponse struct {
@@ -269,7 +407,12 @@ func (t *Tools) WriteJSON(w http.ResponseWriter, status int,
 func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
 	statusCode := http.StatusBadRequest
 
-	if status[0] > 0 {
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		statusCode = statusErr.StatusCode()
+	}
+
+	if len(status) > 0 && status[0] > 0 {
 		statusCode = status[0]
 	}
 
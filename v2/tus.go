@@ -0,0 +1,452 @@
+package toolkit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion  = "1.0.0"
+	tusIDLength = 32
+
+	// completedTusRetention is how long a finished upload is remembered when
+	// the handler has no Expiration, so clients that lost the response to
+	// their last PATCH can still learn that it went through.
+	completedTusRetention = 24 * time.Hour
+)
+
+var tusIDPattern = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+type TusHandler struct {
+	BasePath   string
+	MaxSize    int64
+	Expiration time.Duration
+	OnComplete func(r *http.Request, f *UploadedFile)
+
+	tools     *Tools
+	uploadDir string
+	locks     sync.Map
+}
+
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at,omitempty"`
+	Completed bool              `json:"completed,omitempty"`
+}
+
+func (t *Tools) NewTusHandler(uploadDir, basePath string) *TusHandler {
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1073741824
+	}
+
+	return &TusHandler{
+		BasePath:  strings.TrimRight(basePath, "/"),
+		MaxSize:   t.MaxFileSize,
+		tools:     t,
+		uploadDir: uploadDir,
+	}
+}
+
+func (h *TusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration,termination")
+		if h.MaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		h.create(w, r)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, h.BasePath), "/")
+	if !tusIDPattern.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Only uploads that exist get a lock, so unknown IDs cannot fill the
+	// lock map; one removed while waiting for its lock drops the entry again.
+	if _, err := os.Stat(h.infoPath(id)); errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+
+	lock := h.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, err := h.load(id)
+	if errors.Is(err, os.ErrNotExist) {
+		h.locks.Delete(id)
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !upload.ExpiresAt.IsZero() && time.Now().After(upload.ExpiresAt) {
+		h.remove(id)
+		http.Error(w, "upload expired", http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		h.head(w, upload)
+	case http.MethodPatch:
+		h.patch(w, r, upload)
+	case http.MethodDelete:
+		h.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST, HEAD, PATCH, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *TusHandler) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+
+	if h.MaxSize > 0 && length > h.MaxSize {
+		http.Error(w, "upload exceeds maximum size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload := &tusUpload{
+		ID:        h.tools.RandomString(tusIDLength),
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}
+	if h.Expiration > 0 {
+		upload.ExpiresAt = upload.CreatedAt.Add(h.Expiration)
+	}
+
+	if err := h.tools.CreateDirIfNotExists(h.uploadDir); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	quota, err := h.tools.newQuotaTracker(r.Context(), h.uploadDir, length)
+	if err == nil && quota != nil {
+		err = quota.reserve(length)
+	}
+	if err != nil {
+		h.completionError(w, err)
+		return
+	}
+
+	f, err := os.Create(h.partPath(upload.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	if err := h.save(upload); err != nil {
+		h.remove(upload.ID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", h.BasePath+"/"+upload.ID)
+	h.setExpires(w, upload)
+
+	if length == 0 {
+		if err := h.complete(r, upload); err != nil {
+			h.completionError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *TusHandler) head(w http.ResponseWriter, upload *tusUpload) {
+	offset, err := h.offset(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(upload.Metadata))
+	}
+	h.setExpires(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TusHandler) patch(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "invalid Content-Type header", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := h.offset(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset < 0 {
+		http.Error(w, "invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+	if requestOffset != offset {
+		http.Error(w, "mismatched Upload-Offset", http.StatusConflict)
+		return
+	}
+
+	// A retried final PATCH finds the upload already complete.
+	if upload.Completed {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		h.setExpires(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	f, err := os.OpenFile(h.partPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Keep whatever arrived before a dropped connection so the client can resume.
+	var body io.Reader = r.Body
+	if h.tools.wrapsBody(r.Context()) {
+		cr := newContextReader(r.Context(), r.Body, h.tools.FileIdleTimeout)
+		defer cr.stop()
+		body = cr
+	}
+	written, copyErr := io.Copy(f, io.LimitReader(body, upload.Length-offset))
+	if err := f.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	offset += written
+
+	if h.Expiration > 0 {
+		upload.ExpiresAt = time.Now().Add(h.Expiration)
+		if err := h.save(upload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if copyErr != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(copyErr, context.DeadlineExceeded) {
+			status = http.StatusRequestTimeout
+		}
+		http.Error(w, copyErr.Error(), status)
+		return
+	}
+
+	if offset == upload.Length {
+		if err := h.complete(r, upload); err != nil {
+			h.completionError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.setExpires(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete stores the finished upload and replaces its partial file with a
+// record marked complete, which is kept until the upload expires.
+func (h *TusHandler) complete(r *http.Request, upload *tusUpload) (err error) {
+	defer func() {
+		if err != nil {
+			h.remove(upload.ID)
+		}
+	}()
+
+	f, err := os.Open(h.partPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fileName := filepath.Base(upload.Metadata["filename"])
+	if fileName == "." || fileName == string(filepath.Separator) {
+		fileName = ""
+	}
+
+	uploadedFile, err := h.tools.saveUploadedFile(r.Context(),
+		&uploadPart{fileName: fileName, r: f}, h.uploadDir, true)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string][]string, len(upload.Metadata))
+	for k, v := range upload.Metadata {
+		values[k] = []string{v}
+	}
+
+	err = h.tools.writeSidecars(r.Context(), h.uploadDir, uploadedFile.files(), values,
+		r.Header.Get(RequestIDHeader))
+	if err != nil {
+		return err
+	}
+
+	upload.Completed = true
+	if upload.ExpiresAt.IsZero() {
+		upload.ExpiresAt = time.Now().Add(completedTusRetention)
+	}
+	if err := h.save(upload); err != nil {
+		return err
+	}
+	_ = os.Remove(h.partPath(upload.ID))
+
+	if h.OnComplete != nil {
+		for _, f := range uploadedFile.files() {
+			h.OnComplete(r, f)
+		}
+	}
+	return nil
+}
+
+func (h *TusHandler) completionError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		status = statusErr.StatusCode()
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (h *TusHandler) setExpires(w http.ResponseWriter, upload *tusUpload) {
+	if !upload.ExpiresAt.IsZero() {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+func (h *TusHandler) lock(id string) *sync.Mutex {
+	lock, _ := h.locks.LoadOrStore(id, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+func (h *TusHandler) partPath(id string) string {
+	return filepath.Join(h.uploadDir, id+".part")
+}
+
+// infoPath starts with a dot, like a sidecar, so quotas and downloads treat
+// the record as bookkeeping rather than an upload.
+func (h *TusHandler) infoPath(id string) string {
+	return filepath.Join(h.uploadDir, "."+id+".info")
+}
+
+func (h *TusHandler) offset(upload *tusUpload) (int64, error) {
+	if upload.Completed {
+		return upload.Length, nil
+	}
+	stat, err := os.Stat(h.partPath(upload.ID))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (h *TusHandler) load(id string) (*tusUpload, error) {
+	data, err := os.ReadFile(h.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (h *TusHandler) save(upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.infoPath(upload.ID), data, 0644)
+}
+
+func (h *TusHandler) remove(id string) {
+	_ = os.Remove(h.partPath(id))
+	_ = os.Remove(h.infoPath(id))
+	h.locks.Delete(id)
+}
+
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata header")
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for key %q", key)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return strings.Join(pairs, ",")
+}
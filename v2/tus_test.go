@@ -0,0 +1,224 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tusRequest(method, target string, body []byte, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestTusHandler(t *testing.T) {
+	img := readTestImage(t)
+	uploadDir := t.TempDir()
+
+	testTools := Tools{AllowedFileTypes: []string{"image/jpeg"}}
+	handler := testTools.NewTusHandler(uploadDir, "/files/")
+	handler.Expiration = time.Hour
+
+	var completed *UploadedFile
+	handler.OnComplete = func(r *http.Request, f *UploadedFile) {
+		completed = f
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("OPTIONS", "/files/", nil))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Tus-Extension") == "" {
+		t.Fatalf("unexpected OPTIONS response %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/files/", nil))
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 without Tus-Resumable, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("POST", "/files/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(img)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("photo.jpg")),
+	}))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Upload-Expires") == "" {
+		t.Error("expected Upload-Expires header")
+	}
+	location := rr.Header().Get("Location")
+
+	half := len(img) / 2
+	patch := map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("PATCH", location, img[:half], patch))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("unexpected PATCH response %d, offset %s", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("PATCH", location, img[half:], patch))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for wrong offset, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("HEAD", location, nil, nil))
+	if rr.Header().Get("Upload-Offset") != strconv.Itoa(half) ||
+		rr.Header().Get("Upload-Length") != strconv.Itoa(len(img)) {
+		t.Errorf("unexpected HEAD headers %v", rr.Header())
+	}
+
+	patch["Upload-Offset"] = strconv.Itoa(half)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("PATCH", location, img[half:], patch))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("unexpected final PATCH response %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if completed == nil {
+		t.Fatal("expected OnComplete to be called")
+	}
+	if completed.OriginalFileName != "photo.jpg" || completed.FileSize != int64(len(img)) {
+		t.Errorf("unexpected uploaded file %+v", completed)
+	}
+
+	data, err := os.ReadFile(filepath.Join(uploadDir, completed.NewFileName))
+	if err != nil || !bytes.Equal(data, img) {
+		t.Errorf("completed file does not match upload: %v", err)
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 2 {
+		t.Errorf("expected only the file and its upload record, found %d entries", len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, location[len("/files/"):]+".part")); !os.IsNotExist(err) {
+		t.Errorf("expected the partial upload to be removed, got %v", err)
+	}
+
+	// A client that lost the response to its last PATCH can find out that
+	// the upload finished, and a retried PATCH does not store it twice.
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("HEAD", location, nil, nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != strconv.Itoa(len(img)) {
+		t.Errorf("expected completed upload at offset %d, got %d %s", len(img), rr.Code,
+			rr.Header().Get("Upload-Offset"))
+	}
+
+	completed = nil
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("PATCH", location, img[half:], patch))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a stale offset after completion, got %d", rr.Code)
+	}
+	patch["Upload-Offset"] = strconv.Itoa(len(img))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("PATCH", location, nil, patch))
+	if rr.Code != http.StatusNoContent || completed != nil {
+		t.Errorf("expected a retried final PATCH to be acknowledged once, got %d", rr.Code)
+	}
+
+	// The record goes once the upload expires.
+	upload, err := handler.load(location[len("/files/"):])
+	if err != nil || !upload.Completed {
+		t.Fatalf("expected a completed upload record, got %+v, %v", upload, err)
+	}
+	upload.ExpiresAt = time.Now().Add(-time.Second)
+	handler.save(upload)
+
+	err = testTools.NewJanitor(JanitorOptions{Dirs: []string{uploadDir}}).Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = os.ReadDir(uploadDir)
+	if len(entries) != 1 {
+		t.Errorf("expected the expired upload record to be removed, found %d entries", len(entries))
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("HEAD", location, nil, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a forgotten upload, got %d", rr.Code)
+	}
+}
+
+func TestTusHandler_TypeNotAllowed(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+	handler := testTools.NewTusHandler(t.TempDir(), "/files")
+
+	img := readTestImage(t)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("POST", "/files", nil, map[string]string{
+		"Upload-Length": strconv.Itoa(len(img)),
+	}))
+	location := rr.Header().Get("Location")
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("PATCH", location, img, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", rr.Code)
+	}
+}
+
+func TestTusHandler_Termination(t *testing.T) {
+	var testTools Tools
+	handler := testTools.NewTusHandler(t.TempDir(), "/files")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("POST", "/files", nil, map[string]string{
+		"Upload-Length": "100",
+	}))
+	location := rr.Header().Get("Location")
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("DELETE", location, nil, nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("HEAD", location, nil, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after termination, got %d", rr.Code)
+	}
+
+	for i := 0; i < 10; i++ {
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, tusRequest("HEAD", "/files/unknown"+strconv.Itoa(i), nil, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for an unknown upload, got %d", rr.Code)
+		}
+	}
+	handler.locks.Range(func(id, _ any) bool {
+		t.Errorf("unexpected lock left for %v", id)
+		return true
+	})
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest("POST", "/files", nil, map[string]string{
+		"Upload-Length": strconv.FormatInt(testTools.MaxFileSize+1, 10),
+	}))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,486 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	sniffLen          = 8 << 10
+	tempFilePrefix    = ".upload-"
+	maxFormValueBytes = 10 << 20
+)
+
+type uploadBatch struct {
+	uploadDir  string
+	renameFile bool
+	counts     map[string]int
+	files      []*UploadedFile
+	values     map[string][]string
+	sink       FileSink
+	body       *contextReader
+	quota      *quotaTracker
+	progress   *progressTracker
+}
+
+func (t *Tools) addUploadedFile(ctx context.Context, batch *uploadBatch,
+	part *uploadPart) error {
+	if policy, ok := t.UploadPolicies[part.field]; ok {
+		if policy.MaxFiles > 0 && batch.counts[part.field] >= policy.MaxFiles {
+			uploadErr := part.error(ErrTooManyFiles)
+			uploadErr.Limit = int64(policy.MaxFiles)
+			return uploadErr
+		}
+	}
+
+	part.fieldFiles = batch.counts[part.field]
+	part.rollback = t.AllOrNothing && batch.sink == nil
+	part.quota = batch.quota
+	part.sink = batch.sink
+
+	fileCtx, cancel := t.fileContext(ctx)
+	defer cancel()
+	if batch.body != nil {
+		batch.body.setContext(fileCtx)
+		defer batch.body.setContext(ctx)
+	}
+	part.r = &doneReader{r: part.r, ctx: fileCtx}
+
+	if batch.progress != nil {
+		batch.progress.startFile(part)
+		part.r = batch.progress.file(part.r)
+	}
+
+	uploadedFile, err := t.saveUploadedFile(fileCtx, part, batch.uploadDir, batch.renameFile)
+	if err != nil {
+		return contextError(fileCtx, err)
+	}
+
+	for _, f := range uploadedFile.files() {
+		batch.counts[part.field]++
+		batch.files = append(batch.files, f)
+	}
+
+	if batch.progress != nil {
+		batch.progress.finishFile()
+	}
+	return nil
+}
+
+func (t *Tools) streamMultipleFiles(r *http.Request, batch *uploadBatch) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return uploadError(err)
+	}
+
+	valueBytes := int64(maxFormValueBytes)
+
+	for {
+		if err := context.Cause(r.Context()); err != nil {
+			return err
+		}
+
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return contextError(r.Context(), uploadError(err))
+		}
+
+		if part.FileName() == "" {
+			err = batch.addValue(part, &valueBytes)
+			part.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = t.addUploadedFile(r.Context(), batch, &uploadPart{
+			field:    part.FormName(),
+			fileName: part.FileName(),
+			header:   part.Header,
+			r:        part,
+		})
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addValue records a text field of a streamed form. remaining is the budget
+// shared by all text fields, matching the limit ParseMultipartForm applies.
+func (batch *uploadBatch) addValue(part *multipart.Part, remaining *int64) error {
+	value, err := io.ReadAll(io.LimitReader(part, *remaining+1))
+	if err != nil {
+		return uploadError(err)
+	}
+	*remaining -= int64(len(value))
+	if *remaining < 0 {
+		return uploadError(multipart.ErrMessageTooLarge)
+	}
+
+	if batch.values == nil {
+		batch.values = make(map[string][]string)
+	}
+	name := part.FormName()
+	batch.values[name] = append(batch.values[name], string(value))
+	return nil
+}
+
+type uploadPart struct {
+	field       string
+	fileName    string
+	header      textproto.MIMEHeader
+	r           io.Reader
+	fromArchive bool
+	fieldFiles  int
+	rollback    bool
+	reserved    map[string]bool
+	quota       *quotaTracker
+	sink        FileSink
+}
+
+func (t *Tools) saveUploadedFile(ctx context.Context, part *uploadPart,
+	uploadDir string, renameFile bool) (*UploadedFile, error) {
+	var uploadedFile UploadedFile
+
+	maxFileSize := t.MaxFileSize
+	if policy, ok := t.UploadPolicies[part.field]; ok && policy.MaxFileSize > 0 {
+		maxFileSize = policy.MaxFileSize
+	}
+
+	buff := make([]byte, sniffLen)
+	n, err := io.ReadFull(part.r, buff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, uploadError(err)
+	}
+	buff = buff[:n]
+
+	fileType := t.DetectContentType(buff)
+	extract := t.extractsArchive(fileType, part)
+
+	// An archive that is going to be extracted is checked entry by entry
+	// instead.
+	if !extract {
+		if err := t.checkFileType(part, fileType); err != nil {
+			return nil, err
+		}
+	}
+
+	safeName := t.SanitizeFileName(part.fileName)
+
+	if t.VerifyExtensions && !extensionMatches(fileType, filepath.Ext(safeName)) {
+		uploadErr := part.error(ErrExtensionMismatch)
+		uploadErr.FileType = fileType
+		return nil, uploadErr
+	}
+
+	uploadedFile.OriginalFileName = part.fileName
+	uploadedFile.field = part.field
+	uploadedFile.FileType = fileType
+
+	var replaces bool
+	switch {
+	case renameFile:
+		uploadedFile.NewFileName = fmt.Sprintf("%s%s",
+			t.RandomString(12), storedExtension(fileType, filepath.Ext(safeName)))
+	case t.ContentAddressed, part.sink != nil:
+		uploadedFile.NewFileName = safeName
+	default:
+		uploadedFile.NewFileName, err = t.resolveCollision(ctx, uploadDir, safeName, t.OnCollision,
+			part.reserved)
+		if errors.Is(err, ErrFileExists) {
+			return nil, part.error(ErrFileExists)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// A file that replaces another is held back until the whole batch
+		// has succeeded, so a rollback cannot take the older file with it.
+		if part.rollback && t.OnCollision == CollisionOverwrite {
+			_, err := t.statStored(ctx, storageKey(uploadDir, uploadedFile.NewFileName))
+			replaces = err == nil
+		}
+	}
+
+	digests, err := t.newDigester(part.header)
+	if err != nil {
+		return nil, err
+	}
+
+	src := io.MultiReader(bytes.NewReader(buff), part.r)
+
+	// The entries of an extracted archive count against the quota, the
+	// archive itself does not.
+	if part.quota != nil && !extract {
+		if err := part.quota.addFile(); err != nil {
+			return nil, err
+		}
+		src = part.quota.reader(src)
+	}
+
+	in := digests.reader(&maxSizeReader{r: src, remaining: maxFileSize})
+
+	staged := part.sink == nil && (t.ContentAddressed || t.Scanner != nil ||
+		t.processesImage(fileType) || extract || replaces)
+
+	key := storageKey(uploadDir, uploadedFile.NewFileName)
+	if staged {
+		key = storageKey(uploadDir, tempFilePrefix+t.RandomString(16))
+	}
+	if replaces {
+		uploadedFile.heldKey = key
+	}
+
+	var fileSize int64
+	if part.sink != nil {
+		fileSize, err = t.writeSink(ctx, part, &uploadedFile, in)
+	} else {
+		fileSize, err = t.storage().Put(ctx, key, in)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrFileTooLarge):
+			uploadErr := part.error(ErrFileTooLarge)
+			uploadErr.Limit = maxFileSize
+			return nil, uploadErr
+		case errors.Is(err, ErrDigestMismatch):
+			return nil, part.error(ErrDigestMismatch)
+		}
+		return nil, uploadError(err)
+	}
+	uploadedFile.FileSize = fileSize
+	uploadedFile.Hashes = digests.sums()
+
+	ttl := t.UploadTTL
+	if policy, ok := t.UploadPolicies[part.field]; ok && policy.TTL > 0 {
+		ttl = policy.TTL
+	}
+	if ttl > 0 && part.sink == nil {
+		uploadedFile.ExpiresAt = time.Now().Add(ttl).UTC()
+	}
+
+	if staged {
+		err = t.commitStaged(ctx, key, uploadDir, renameFile, fileType, &uploadedFile, part, digests)
+		if err != nil {
+			_ = t.storage().Delete(context.WithoutCancel(ctx), key)
+			return nil, err
+		}
+	}
+
+	return &uploadedFile, nil
+}
+
+// commitStaged runs the checks that need the complete file on the temporary
+// copy at key before moving it to its final name.
+func (t *Tools) commitStaged(ctx context.Context, key, uploadDir string, renameFile bool,
+	fileType string, uploadedFile *UploadedFile, part *uploadPart, digests *digester) error {
+	var img image.Image
+	var err error
+
+	if t.Scanner != nil {
+		if err := t.scanStaged(ctx, key, uploadedFile, part); err != nil {
+			return err
+		}
+	}
+
+	if t.extractsArchive(fileType, part) {
+		uploadedFile.extracted, err = t.extractArchive(ctx, key, fileType, uploadDir,
+			renameFile, uploadedFile, part)
+		if err == nil {
+			return t.storage().Delete(ctx, key)
+		}
+		if err != errNotArchive {
+			return err
+		}
+		if err := t.checkFileType(part, fileType); err != nil {
+			return err
+		}
+	}
+
+	if t.processesImage(fileType) {
+		img, err = t.processImage(ctx, key, fileType, uploadedFile, part, digests)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.ContentAddressed {
+		uploadedFile.NewFileName = digests.sum(HashSHA256) + filepath.Ext(uploadedFile.NewFileName)
+
+		uploadedFile.Deduplicated, err = t.commitDeduplicated(ctx, key,
+			storageKey(uploadDir, uploadedFile.NewFileName))
+	} else if uploadedFile.heldKey == "" {
+		err = moveStored(ctx, t.storage(), key, storageKey(uploadDir, uploadedFile.NewFileName))
+	}
+	if err != nil {
+		return err
+	}
+
+	if img != nil && len(t.ImageProcessing.Variants) > 0 {
+		err = t.saveImageVariants(ctx, uploadDir, fileType, img, uploadedFile, part)
+		if err != nil {
+			t.removeUploadedFiles(context.WithoutCancel(ctx), uploadDir,
+				[]*UploadedFile{uploadedFile})
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Tools) commitDeduplicated(ctx context.Context, tempName, name string) (bool, error) {
+	s := t.storage()
+
+	_, err := s.Stat(ctx, name)
+	if err == nil {
+		return true, s.Delete(ctx, tempName)
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		err = moveStored(ctx, s, tempName, name)
+	}
+	if err != nil {
+		_ = s.Delete(ctx, tempName)
+		return false, err
+	}
+	return false, nil
+}
+
+// commitHeld moves the files held back because they replace existing ones to
+// their final names once the whole batch has succeeded.
+func (t *Tools) commitHeld(ctx context.Context, uploadDir string,
+	uploadedFiles []*UploadedFile) error {
+	for _, f := range uploadedFiles {
+		if f.heldKey == "" {
+			continue
+		}
+		err := moveStored(ctx, t.storage(), f.heldKey, storageKey(uploadDir, f.NewFileName))
+		if err != nil {
+			return err
+		}
+		f.heldKey = ""
+	}
+	return nil
+}
+
+func (t *Tools) removeUploadedFiles(ctx context.Context, uploadDir string,
+	uploadedFiles []*UploadedFile) {
+	for _, f := range uploadedFiles {
+		// A deduplicated file belongs to an earlier upload as well.
+		if f.Deduplicated {
+			continue
+		}
+		// A held file has not replaced anything yet, and the file under its
+		// name belongs to an earlier upload.
+		if f.heldKey != "" {
+			_ = t.storage().Delete(ctx, f.heldKey)
+		} else {
+			_ = t.storage().Delete(ctx, storageKey(uploadDir, f.NewFileName))
+			_ = t.storage().Delete(ctx, storageKey(uploadDir, sidecarName(f.NewFileName)))
+		}
+		for _, v := range f.Variants {
+			_ = t.storage().Delete(ctx, storageKey(uploadDir, v.FileName))
+		}
+	}
+}
+
+func (t *Tools) checkFileType(part *uploadPart, fileType string) error {
+	allowedTypes := t.AllowedFileTypes
+
+	if policy, ok := t.UploadPolicies[part.field]; ok {
+		if !policy.extensionAllowed(part.fileName) {
+			return part.error(ErrExtensionNotAllowed)
+		}
+		if len(policy.AllowedFileTypes) > 0 {
+			allowedTypes = policy.AllowedFileTypes
+		}
+	}
+
+	if !fileTypeAllowed(allowedTypes, fileType) {
+		uploadErr := part.error(ErrFileTypeNotAllowed)
+		uploadErr.FileType = fileType
+		return uploadErr
+	}
+	return nil
+}
+
+// scriptableTypes can carry scripts that run when the file is opened in a
+// browser, so wildcards such as "image/*" or "text/*" do not match them; they
+// have to be allowed by name.
+var scriptableTypes = map[string]bool{
+	"image/svg+xml":         true,
+	"text/html":             true,
+	"text/xml":              true,
+	"application/xml":       true,
+	"application/xhtml+xml": true,
+}
+
+func fileTypeAllowed(allowedTypes []string, fileType string) bool {
+	if len(allowedTypes) == 0 {
+		return true
+	}
+
+	mediaType := baseMediaType(fileType)
+	wildcards := !scriptableTypes[strings.ToLower(mediaType)]
+
+	for _, x := range allowedTypes {
+		if strings.EqualFold(x, fileType) || strings.EqualFold(x, mediaType) {
+			return true
+		}
+		if !wildcards {
+			continue
+		}
+		if x == "*/*" {
+			return true
+		}
+
+		// Wildcard entries such as "image/*" match a whole top level type.
+		if prefix, ok := strings.CutSuffix(x, "/*"); ok &&
+			strings.EqualFold(prefix, strings.SplitN(mediaType, "/", 2)[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.remaining <= 0 {
+		// Probe for one more byte so a file of exactly the limit is accepted.
+		var probe [1]byte
+		n, err := m.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrFileTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > m.remaining {
+		p = p[:m.remaining]
+	}
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	return n, err
+}
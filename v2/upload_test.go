@@ -0,0 +1,223 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testFormFile struct {
+	field    string
+	fileName string
+	content  []byte
+}
+
+func newUploadRequest(t *testing.T, files ...testFormFile) *http.Request {
+	t.Helper()
+	return newUploadRequestWithValues(t, nil, files...)
+}
+
+func newUploadRequestWithValues(t *testing.T, values url.Values,
+	files ...testFormFile) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for key, vs := range values {
+		for _, v := range vs {
+			if err := writer.WriteField(key, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, f := range files {
+		part, err := writer.CreateFormFile(f.field, f.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write(f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func readTestImage(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile("./testdata/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTools_UploadMultipleFilesStreaming(t *testing.T) {
+	img := readTestImage(t)
+
+	var streamTests = []struct {
+		name           string
+		files          []testFormFile
+		maxFileSize    int64
+		maxRequestSize int64
+		allowedTypes   []string
+		expectedErr    error
+		expectedFiles  int
+	}{
+		{name: "single file",
+			files:         []testFormFile{{"file", "image.jpg", img}},
+			allowedTypes:  []string{"image/jpeg"},
+			expectedFiles: 1},
+		{name: "multiple files",
+			files: []testFormFile{{"file", "image.jpg", img},
+				{"file", "notes.txt", []byte("hello world")}},
+			expectedFiles: 2},
+		{name: "file exactly at limit",
+			files:         []testFormFile{{"file", "notes.txt", []byte("hello world")}},
+			maxFileSize:   11,
+			expectedFiles: 1},
+		{name: "file too large",
+			files:       []testFormFile{{"file", "image.jpg", img}},
+			maxFileSize: 1024,
+			expectedErr: ErrFileTooLarge},
+		{name: "request too large",
+			files:          []testFormFile{{"file", "image.jpg", img}},
+			maxRequestSize: 2048,
+			expectedErr:    ErrRequestTooLarge},
+		{name: "type not allowed",
+			files:        []testFormFile{{"file", "image.jpg", img}},
+			allowedTypes: []string{"image/png"},
+			expectedErr:  ErrFileTypeNotAllowed},
+	}
+
+	for _, e := range streamTests {
+		uploadDir := t.TempDir()
+
+		testTools := Tools{
+			MaxFileSize:      e.maxFileSize,
+			MaxRequestSize:   e.maxRequestSize,
+			AllowedFileTypes: e.allowedTypes,
+			StreamUploads:    true,
+		}
+
+		uploadedFiles, err := testTools.UploadMultipleFiles(
+			newUploadRequest(t, e.files...), uploadDir)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+
+		if len(uploadedFiles) != e.expectedFiles {
+			t.Errorf("%s: expected %d uploaded files, got %d", e.name, e.expectedFiles, len(uploadedFiles))
+		}
+
+		entries, _ := os.ReadDir(uploadDir)
+		if len(entries) != e.expectedFiles {
+			t.Errorf("%s: expected %d files on disk, got %d", e.name, e.expectedFiles, len(entries))
+		}
+
+		for i, f := range uploadedFiles {
+			stat, err := os.Stat(filepath.Join(uploadDir, f.NewFileName))
+			if err != nil {
+				t.Errorf("%s: expected file to exist: %v", e.name, err)
+				continue
+			}
+			if stat.Size() != int64(len(e.files[i].content)) || f.FileSize != stat.Size() {
+				t.Errorf("%s: wrong file size %d", e.name, stat.Size())
+			}
+		}
+	}
+}
+
+func TestTools_UploadAllOrNothing(t *testing.T) {
+	img := readTestImage(t)
+
+	for _, allOrNothing := range []bool{false, true} {
+		for _, stream := range []bool{false, true} {
+			uploadDir := t.TempDir()
+
+			testTools := Tools{
+				AllowedFileTypes: []string{"image/jpeg"},
+				StreamUploads:    stream,
+				AllOrNothing:     allOrNothing,
+			}
+
+			uploadedFiles, err := testTools.UploadMultipleFiles(newUploadRequest(t,
+				testFormFile{"file", "image.jpg", img},
+				testFormFile{"file", "notes.txt", []byte("hello world")}), uploadDir)
+			if !errors.Is(err, ErrFileTypeNotAllowed) {
+				t.Errorf("expected type not allowed error, got %v", err)
+			}
+
+			expected := 1
+			if allOrNothing {
+				expected = 0
+			}
+
+			if len(uploadedFiles) != expected {
+				t.Errorf("all or nothing %v, stream %v: expected %d uploaded files, got %d",
+					allOrNothing, stream, expected, len(uploadedFiles))
+			}
+
+			entries, _ := os.ReadDir(uploadDir)
+			if len(entries) != expected {
+				t.Errorf("all or nothing %v, stream %v: expected %d files on disk, got %d",
+					allOrNothing, stream, expected, len(entries))
+			}
+		}
+	}
+}
+
+func TestTools_UploadAllOrNothingReplaced(t *testing.T) {
+	pdf := []byte("%PDF-1.4 new report")
+
+	for _, stream := range []bool{false, true} {
+		for _, fail := range []bool{false, true} {
+			uploadDir := t.TempDir()
+			existing := filepath.Join(uploadDir, "report.pdf")
+			if err := os.WriteFile(existing, []byte("%PDF-1.4 old report"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			testTools := Tools{
+				AllowedFileTypes: []string{"application/pdf"},
+				StreamUploads:    stream,
+				AllOrNothing:     true,
+			}
+
+			files := []testFormFile{{"file", "report.pdf", pdf}}
+			expected := string(pdf)
+			if fail {
+				files = append(files, testFormFile{"file", "notes.txt", []byte("hello world")})
+				expected = "%PDF-1.4 old report"
+			}
+
+			_, err := testTools.UploadMultipleFiles(newUploadRequest(t, files...), uploadDir, false)
+			if fail != (err != nil) {
+				t.Errorf("stream %v, fail %v: unexpected error %v", stream, fail, err)
+			}
+
+			if content, _ := os.ReadFile(existing); string(content) != expected {
+				t.Errorf("stream %v, fail %v: expected %q, got %q", stream, fail, expected, content)
+			}
+			if entries, _ := os.ReadDir(uploadDir); len(entries) != 1 {
+				t.Errorf("stream %v, fail %v: expected a single file on disk, got %d",
+					stream, fail, len(entries))
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package toolkit
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// ZipFile is an entry of a zip download. Path names the file to read and
+// Name the path it gets inside the archive, which defaults to the original
+// name recorded in its sidecar or else the base name of Path.
+type ZipFile struct {
+	Path string
+	Name string
+}
+
+var ErrInvalidCompressionLevel = errors.New("the zip compression level must be between 1 and 9")
+
+type zipEntry struct {
+	path    string
+	name    string
+	modTime time.Time
+}
+
+// DownloadZip streams a zip archive of files to w as displayName, which
+// defaults to download.zip. Files are read from fsys, with names checked as
+// described for DownloadRoot, or from the configured storage when fsys is
+// nil, and are decrypted when Encryption is set. The archive is written as it
+// is read, so nothing is held in memory or on disk. Entries are compressed at
+// ZipCompressionLevel, 1 to 9; zero picks the default level and a negative
+// level stores them uncompressed. Any other level fails with
+// ErrInvalidCompressionLevel before anything is sent.
+//
+// Every file is looked up before anything is sent, and a missing one gets a
+// 404. Once the archive has started, an error such as the client going away
+// can only stop it; DownloadZip then returns the error.
+func (t *Tools) DownloadZip(w http.ResponseWriter, r *http.Request, fsys fs.FS,
+	files []ZipFile, displayName string) error {
+	ctx := r.Context()
+
+	if t.ZipCompressionLevel > flate.BestCompression {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return ErrInvalidCompressionLevel
+	}
+
+	var open func(ctx context.Context, name string) (io.ReadCloser, error)
+	var entries []*zipEntry
+	var err error
+	if fsys == nil {
+		entries, err = t.storageZipEntries(ctx, files)
+		open = t.getStored
+	} else {
+		d := t.NewDownloadFS(fsys)
+		entries, err = d.zipEntries(ctx, files)
+		open = func(ctx context.Context, name string) (io.ReadCloser, error) {
+			file, err := d.openContent(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			return struct {
+				io.Reader
+				io.Closer
+			}{file.content, file}, nil
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return err
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return err
+	}
+
+	if displayName == "" {
+		displayName = "download.zip"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", ContentDisposition(t.Disposition, displayName))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	zw := zip.NewWriter(w)
+	method := zip.Deflate
+	switch level := t.ZipCompressionLevel; {
+	case level < 0:
+		method = zip.Store
+	case level > 0:
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+
+	for _, e := range entries {
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		if err := writeZipEntry(ctx, zw, e, method, open); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeZipEntry(ctx context.Context, zw *zip.Writer, e *zipEntry, method uint16,
+	open func(ctx context.Context, name string) (io.ReadCloser, error)) error {
+	content, err := open(ctx, e.path)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     e.name,
+		Method:   method,
+		Modified: e.modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, &doneReader{r: content, ctx: ctx})
+	return err
+}
+
+func (t *Tools) storageZipEntries(ctx context.Context, files []ZipFile) ([]*zipEntry, error) {
+	entries := make([]*zipEntry, 0, len(files))
+	for _, f := range files {
+		info, err := t.statStored(ctx, f.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		name := f.Name
+		if record := t.lookupDownload(ctx, f.Path); record != nil {
+			if record.expired() {
+				return nil, notExist(f.Path)
+			}
+			if name == "" && t.Sidecars {
+				name = record.OriginalFileName
+			}
+		}
+		entries = append(entries, &zipEntry{path: f.Path, name: name, modTime: info.ModTime})
+	}
+	return t.zipEntryNames(entries), nil
+}
+
+func (d *DownloadRoot) zipEntries(ctx context.Context, files []ZipFile) ([]*zipEntry, error) {
+	entries := make([]*zipEntry, 0, len(files))
+	for _, f := range files {
+		name := strings.TrimPrefix(f.Path, "/")
+		file, info, err := d.open(name)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+
+		displayName := f.Name
+		if record := d.record(ctx, name); record != nil {
+			if record.expired() {
+				return nil, notExist(name)
+			}
+			if displayName == "" && d.t.Sidecars {
+				displayName = record.OriginalFileName
+			}
+		}
+		entries = append(entries, &zipEntry{path: name, name: displayName, modTime: info.ModTime()})
+	}
+	return d.t.zipEntryNames(entries), nil
+}
+
+// zipEntryNames makes the entry names safe to extract and unique. Each
+// element of a name is sanitized and relative elements are dropped, so an
+// archive cannot write outside the directory it is extracted to. Duplicate
+// names get a numbered suffix.
+func (t *Tools) zipEntryNames(entries []*zipEntry) []*zipEntry {
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		name := e.name
+		if name == "" {
+			name = path.Base(e.path)
+		}
+
+		var elems []string
+		for _, elem := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+			if elem == "." || elem == ".." {
+				continue
+			}
+			elems = append(elems, t.SanitizeFileName(elem))
+		}
+		if len(elems) == 0 {
+			elems = []string{t.SanitizeFileName("")}
+		}
+
+		dir := strings.Join(elems[:len(elems)-1], "/")
+		base := elems[len(elems)-1]
+		ext := path.Ext(base)
+		name = path.Join(dir, base)
+		for i := 1; seen[strings.ToLower(name)]; i++ {
+			name = path.Join(dir, truncateFileName(strings.TrimSuffix(base, ext),
+				fmt.Sprintf(" (%d)", i), ext, t.maxFileNameLength()))
+		}
+		seen[strings.ToLower(name)] = true
+		e.name = name
+	}
+	return entries
+}
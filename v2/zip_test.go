@@ -0,0 +1,176 @@
+package toolkit
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTools_DownloadZip(t *testing.T) {
+	dir := t.TempDir()
+	text := []byte("some text that compresses some text that compresses")
+	for name, content := range map[string][]byte{
+		"a.txt":                 text,
+		"b.txt":                 []byte("b"),
+		"data.bin":              []byte("a,b"),
+		sidecarName("data.bin"): []byte(`{"original_file_name":"données.csv"}`),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mapFS := fstest.MapFS{
+		"static/app.js": {Data: []byte("console.log(1)")},
+		".env":          {Data: []byte("secret")},
+	}
+
+	var zipTests = []struct {
+		name        string
+		tools       Tools
+		fsys        fs.FS
+		files       []ZipFile
+		status      int
+		entries     []string
+		contents    []string
+		method      uint16
+		expectedErr error
+	}{
+		{name: "disk", files: []ZipFile{{Path: filepath.Join(dir, "a.txt")}, {Path: filepath.Join(dir, "b.txt")}},
+			status: http.StatusOK, entries: []string{"a.txt", "b.txt"}, contents: []string{string(text), "b"},
+			method: zip.Deflate},
+		{name: "display names", files: []ZipFile{
+			{Path: filepath.Join(dir, "a.txt"), Name: "docs/notes.txt"},
+			{Path: filepath.Join(dir, "b.txt"), Name: "../../etc/notes.txt"},
+			{Path: filepath.Join(dir, "b.txt"), Name: "Docs/Notes.txt"}},
+			status: http.StatusOK, entries: []string{"docs/notes.txt", "etc/notes.txt", "Docs/Notes (1).txt"},
+			method: zip.Deflate},
+		{name: "sidecar name", tools: Tools{Sidecars: true}, files: []ZipFile{{Path: filepath.Join(dir, "data.bin")}},
+			status: http.StatusOK, entries: []string{"données.csv"}, contents: []string{"a,b"}, method: zip.Deflate},
+		{name: "store", tools: Tools{ZipCompressionLevel: -1}, files: []ZipFile{{Path: filepath.Join(dir, "a.txt")}},
+			status: http.StatusOK, entries: []string{"a.txt"}, contents: []string{string(text)}, method: zip.Store},
+		{name: "best compression", tools: Tools{ZipCompressionLevel: 9}, files: []ZipFile{{Path: filepath.Join(dir, "a.txt")}},
+			status: http.StatusOK, entries: []string{"a.txt"}, contents: []string{string(text)}, method: zip.Deflate},
+		{name: "invalid level", tools: Tools{ZipCompressionLevel: 10}, files: []ZipFile{{Path: filepath.Join(dir, "a.txt")}},
+			status: http.StatusInternalServerError, expectedErr: ErrInvalidCompressionLevel},
+		{name: "fs", fsys: mapFS, files: []ZipFile{{Path: "static/app.js"}},
+			status: http.StatusOK, entries: []string{"app.js"}, contents: []string{"console.log(1)"}, method: zip.Deflate},
+		{name: "fs hidden", fsys: mapFS, files: []ZipFile{{Path: "static/app.js"}, {Path: ".env"}},
+			status: http.StatusNotFound, expectedErr: fs.ErrNotExist},
+		{name: "missing", files: []ZipFile{{Path: filepath.Join(dir, "a.txt")}, {Path: filepath.Join(dir, "missing.txt")}},
+			status: http.StatusNotFound, expectedErr: fs.ErrNotExist},
+		{name: "empty", status: http.StatusOK},
+	}
+
+	for _, e := range zipTests {
+		rr := httptest.NewRecorder()
+		err := e.tools.DownloadZip(rr, httptest.NewRequest("GET", "/", nil), e.fsys, e.files, "")
+
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+		if rr.Code != e.status {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.status, rr.Code)
+			continue
+		}
+		if e.status != http.StatusOK {
+			continue
+		}
+
+		if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="download.zip"` {
+			t.Errorf("%s: wrong disposition %s", e.name, got)
+		}
+		if got := rr.Header().Get("Content-Type"); got != "application/zip" {
+			t.Errorf("%s: wrong content type %s", e.name, got)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		var names []string
+		for i, f := range zr.File {
+			names = append(names, f.Name)
+			if f.Method != e.method {
+				t.Errorf("%s: expected method %d for %s, got %d", e.name, e.method, f.Name, f.Method)
+			}
+			if i >= len(e.contents) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(content) != e.contents[i] {
+				t.Errorf("%s: expected %s to hold %q, got %q (%v)", e.name, f.Name, e.contents[i], content, err)
+			}
+		}
+		if !reflect.DeepEqual(names, e.entries) {
+			t.Errorf("%s: expected entries %v, got %v", e.name, e.entries, names)
+		}
+	}
+}
+
+func TestTools_DownloadZipEncrypted(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{Encryption: &EncryptionOptions{Keys: testKeys()}}
+
+	uploadedFile, err := testTools.UploadOneFile(
+		newUploadRequest(t, testFormFile{"file", "a.txt", []byte("some text")}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	err = testTools.DownloadZip(rr, httptest.NewRequest("GET", "/", nil), nil,
+		[]ZipFile{{Path: filepath.Join(uploadDir, uploadedFile.NewFileName), Name: "a.txt"}}, "files.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if content, _ := io.ReadAll(rc); string(content) != "some text" {
+		t.Errorf("expected the decrypted file, got %q", content)
+	}
+}
+
+func TestTools_DownloadZipCanceled(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("some text"), 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var testTools Tools
+	rr := httptest.NewRecorder()
+	err := testTools.DownloadZip(rr, httptest.NewRequest("GET", "/", nil).WithContext(ctx), nil,
+		[]ZipFile{{Path: filepath.Join(dir, "a.txt")}}, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len())); err == nil {
+		t.Error("expected an incomplete archive")
+	}
+}